@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// Input sizes shared by the generic-versus-loop benchmarks
+var benchSizes = []int{1_000, 100_000, 1_000_000}
+
+func benchInts(n int) []int {
+	items := make([]int, n)
+	for i := range items {
+		if i%4 != 0 { // every fourth value stays zero for Compact
+			items[i] = i * 7 % 1000
+		}
+	}
+	return items
+}
+
+// Lightweight people: no metadata maps, so a million fit comfortably
+func benchPeople(n int) []Person {
+	people := make([]Person, n)
+	for i := range people {
+		if i%4 != 0 {
+			people[i] = Person{ID: UserID(i), Name: firstNames[i%len(firstNames)], Age: 18 + i%60, Status: StatusActive}
+		}
+	}
+	return people
+}
+
+// Runs generic and hand-written variants side by side for every size
+func benchPair[T any](b *testing.B, build func(n int) T, generic, loop func(T)) {
+	for _, n := range benchSizes {
+		items := build(n)
+		b.Run("generic/"+strconv.Itoa(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				generic(items)
+			}
+		})
+		b.Run("loop/"+strconv.Itoa(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				loop(items)
+			}
+		})
+	}
+}
+
+func BenchmarkCompactInts(b *testing.B) {
+	benchPair(b, benchInts,
+		func(items []int) { Compact(items) },
+		func(items []int) {
+			out := make([]int, 0, len(items))
+			for _, v := range items {
+				if v != 0 {
+					out = append(out, v)
+				}
+			}
+		})
+}
+
+func BenchmarkCompactPeople(b *testing.B) {
+	isZero := func(p Person) bool { return p.ID == 0 }
+	benchPair(b, benchPeople,
+		func(people []Person) { CompactFunc(people, isZero) },
+		func(people []Person) {
+			out := make([]Person, 0, len(people))
+			for _, p := range people {
+				if p.ID != 0 {
+					out = append(out, p)
+				}
+			}
+		})
+}
+
+func BenchmarkIndexPeople(b *testing.B) {
+	benchPair(b, benchPeople,
+		func(people []Person) { Index(people, func(p Person) UserID { return p.ID }) },
+		func(people []Person) {
+			index := make(map[UserID]Person, len(people))
+			for _, p := range people {
+				index[p.ID] = p
+			}
+		})
+}
+
+func BenchmarkHistogramPeople(b *testing.B) {
+	benchPair(b, benchPeople,
+		func(people []Person) { Histogram(people, func(p Person) int { return p.Age / 10 }) },
+		func(people []Person) {
+			counts := make(map[int]int)
+			for _, p := range people {
+				counts[p.Age/10]++
+			}
+		})
+}
+
+func BenchmarkMinMaxInts(b *testing.B) {
+	benchPair(b, benchInts,
+		func(items []int) { MinMax(items) },
+		func(items []int) {
+			if len(items) == 0 {
+				return
+			}
+			lo, hi := items[0], items[0]
+			for _, v := range items[1:] {
+				lo, hi = min(lo, v), max(hi, v)
+			}
+			_, _ = lo, hi
+		})
+}
+
+func BenchmarkFindMaxInts(b *testing.B) {
+	less := func(x, y int) bool { return x < y }
+	benchPair(b, benchInts,
+		func(items []int) { FindMax(items, less) },
+		func(items []int) {
+			best := 0
+			for i := range items {
+				if items[i] > items[best] {
+					best = i
+				}
+			}
+			_ = best
+		})
+}
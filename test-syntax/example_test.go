@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+func ExamplePerson_MarshalCanonical() {
+	email := "alice@example.com"
+	p := Person{
+		ID:       1,
+		Name:     "Alice",
+		Age:      30,
+		Email:    &email,
+		Status:   StatusActive,
+		Created:  time.Date(2024, time.January, 1, 9, 0, 0, 0, time.FixedZone("CET", 3600)),
+		Tags:     []string{"golang"},
+		Metadata: map[string]interface{}{"level": "senior", "department": "engineering"},
+	}
+	data, err := p.MarshalCanonical()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(data))
+
+	var back Person
+	if err := json.Unmarshal(data, &back); err != nil {
+		panic(err)
+	}
+	fmt.Println(back.Name, back.Created.Equal(p.Created))
+	// Output:
+	// {"id":1,"name":"Alice","age":30,"email":"alice@example.com","status":"active","created":"2024-01-01T08:00:00Z","tags":["golang"],"metadata":{"department":"engineering","level":"senior"}}
+	// Alice true
+}
+
+func ExampleStatus_Valid() {
+	for _, s := range []Status{StatusActive, StatusPending, "retired", ""} {
+		fmt.Printf("%q valid: %v\n", s, s.Valid())
+	}
+	// Output:
+	// "active" valid: true
+	// "pending" valid: true
+	// "retired" valid: false
+	// "" valid: false
+}
+
+func ExampleDecodePerson() {
+	_, err := DecodePerson([]byte(`{"id":1,"name":"Ann","age":"x","status":"active"}`), DecodeOptions{CoerceNumbers: true})
+	var fe *FieldError
+	var ce *CodedError
+	if errors.As(err, &fe) && errors.As(err, &ce) {
+		fmt.Println(ce.Code, fe.Field)
+	}
+	fmt.Println(errors.Is(fmt.Errorf("lookup: %w", ErrNotFound), ErrNotFound))
+	// Output:
+	// invalid age
+	// true
+}
+
+// The fake clock makes the simulated fetch latency free and the result
+// timestamps fixed
+func Example_fetchUserData() {
+	clock := NewFakeClock(time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC))
+	p, err := fetchUserData(context.Background(), clock, 42)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(p.ID, p.Name, p.Created.Format(time.RFC3339))
+	// Output: 42 John Doe 2024-03-01T12:00:00Z
+}
+
+func ExampleAuditTrail() {
+	clock := NewFakeClock(time.Date(2024, time.March, 1, 9, 0, 0, 0, time.UTC))
+	trail := &AuditTrail{Clock: clock}
+	trail.Record("email", nil, "ann@example.com")
+	clock.Advance(time.Hour)
+	trail.Record("status", StatusPending, StatusActive)
+
+	data, err := json.Marshal(trail)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(data))
+	// Output:
+	// [{"at":"2024-03-01T09:00:00Z","field":"email","old":null,"new":"ann@example.com"},{"at":"2024-03-01T10:00:00Z","field":"status","old":"pending","new":"active"}]
+}
+
+// Map results are printed through SortedPairs for a stable order
+func ExampleHistogram() {
+	people := []Person{
+		{Name: "Ann", Status: StatusActive},
+		{Name: "Bob", Status: StatusPending},
+		{Name: "Cy", Status: StatusActive},
+	}
+	counts := Histogram(people, func(p Person) Status { return p.Status })
+	for _, pair := range SortedPairs(counts) {
+		fmt.Println(pair.Key, pair.Value)
+	}
+	// Output:
+	// active 2
+	// pending 1
+}
@@ -0,0 +1,3 @@
+module github.com/yannickboog/zero-trust-theme/test-syntax
+
+go 1.24
@@ -0,0 +1,5 @@
+// Package namehash is the cgo sample: a 32-bit FNV-1a hash computed in C
+// when cgo is available and in pure Go otherwise. It lives in its own
+// directory so the C and C++ samples next to test.go are not compiled
+// into the main package.
+package namehash
@@ -0,0 +1,29 @@
+//go:build cgo
+
+package namehash
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+#include <string.h>
+
+// 32-bit FNV-1a over a NUL-terminated string
+static uint32_t fnv1a(const char *s) {
+	uint32_t hash = 2166136261u;
+	for (size_t i = 0; i < strlen(s); i++) {
+		hash ^= (unsigned char)s[i];
+		hash *= 16777619u;
+	}
+	return hash;
+}
+*/
+import "C"
+
+import "unsafe"
+
+// Sum wraps the C helper; it must match the !cgo fallback
+func Sum(s string) uint32 {
+	cs := C.CString(s)
+	defer C.free(unsafe.Pointer(cs))
+	return uint32(C.fnv1a(cs))
+}
@@ -0,0 +1,12 @@
+//go:build !cgo
+
+package namehash
+
+import "hash/fnv"
+
+// Sum is the pure Go twin of the cgo helper, used when CGO_ENABLED=0
+func Sum(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
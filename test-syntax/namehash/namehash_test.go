@@ -0,0 +1,17 @@
+package namehash
+
+import (
+	"hash/fnv"
+	"testing"
+)
+
+// Both builds must agree with the standard library's FNV-1a
+func TestSumMatchesFNV1a(t *testing.T) {
+	for _, s := range []string{"", "a", "Alice Johnson", "héllo"} {
+		h := fnv.New32a()
+		h.Write([]byte(s))
+		if got, want := Sum(s), h.Sum32(); got != want {
+			t.Errorf("Sum(%q) = %08x, want %08x", s, got, want)
+		}
+	}
+}
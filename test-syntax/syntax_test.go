@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"testing"
+)
+
+// Package-wide setup: recovered panics are logged by design, so keep them
+// out of the test output
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	code := m.Run()
+	log.SetOutput(os.Stderr)
+	os.Exit(code)
+}
+
+func TestParallelSyntax(t *testing.T) {
+	t.Parallel()
+	less := func(a, b int) bool { return a < b }
+	tests := []struct {
+		name    string
+		numbers []int
+		sum     int
+		max     int
+	}{
+		{"empty", nil, 0, 0},
+		{"one", []int{3}, 3, 3},
+		{"ascending", []int{1, 2, 3, 4}, 10, 4},
+		{"descending", []int{9, 5, 1}, 15, 9},
+		{"negatives", []int{-4, -2, -8}, -14, -2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := sum(tt.numbers...); got != tt.sum {
+				t.Errorf("sum(%v...) = %d, want %d", tt.numbers, got, tt.sum)
+			}
+			if got := FindMax(tt.numbers, less); got != tt.max {
+				t.Errorf("FindMax(%v) = %d, want %d", tt.numbers, got, tt.max)
+			}
+			if len(tt.numbers) > 0 {
+				mean, err := divide(float64(tt.sum), float64(len(tt.numbers)))
+				if err != nil {
+					t.Fatalf("divide: %v", err)
+				}
+				if mean > float64(tt.max) {
+					t.Errorf("mean %v exceeds max %d", mean, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSum(b *testing.B) {
+	numbers := make([]int, 1024)
+	for i := range numbers {
+		numbers[i] = i
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if sum(numbers...) != 1023*1024/2 {
+				b.Error("wrong sum")
+			}
+		}
+	})
+}
+
+func BenchmarkFindMax(b *testing.B) {
+	values := make([]float64, 1024)
+	for i := range values {
+		values[i] = math.Sin(float64(i))
+	}
+	less := func(a, b float64) bool { return a < b }
+	b.ReportAllocs()
+	for b.Loop() {
+		FindMax(values, less)
+	}
+}
+
+func FuzzDivide(f *testing.F) {
+	f.Add(10.0, 2.0)
+	f.Add(1.0, 0.0)
+	f.Add(0.0, 0.0)
+	f.Add(math.Inf(1), math.Inf(-1))
+	f.Add(math.NaN(), 1.0)
+	f.Add(-3.5, 1e-300)
+	f.Fuzz(func(t *testing.T, a, b float64) {
+		q, err := divide(a, b)
+		switch {
+		case b == 0:
+			if !errors.Is(err, ErrDivisionByZero) {
+				t.Fatalf("divide(%v, %v) error = %v, want ErrDivisionByZero", a, b, err)
+			}
+		case math.IsNaN(a / b):
+			if !errors.Is(err, ErrIndeterminate) {
+				t.Fatalf("divide(%v, %v) error = %v, want ErrIndeterminate", a, b, err)
+			}
+		case err != nil:
+			t.Fatalf("divide(%v, %v) unexpected error %v", a, b, err)
+		case q != a/b:
+			t.Fatalf("divide(%v, %v) = %v, want %v", a, b, q, a/b)
+		}
+		if err != nil && q != 0 {
+			t.Fatalf("divide(%v, %v) returned %v alongside an error", a, b, q)
+		}
+	})
+}
+
+func FuzzSum(f *testing.F) {
+	f.Add(0, 0, 0)
+	f.Add(1, -1, 5)
+	f.Add(math.MaxInt, 1, math.MinInt)
+	f.Fuzz(func(t *testing.T, a, b, c int) {
+		got := sum(a, b, c)
+		if got != a+b+c {
+			t.Fatalf("sum(%d, %d, %d) = %d, want %d", a, b, c, got, a+b+c)
+		}
+		if sum(c, b, a) != got || sum(sum(a, b), c) != got {
+			t.Fatalf("sum(%d, %d, %d) depends on grouping or order", a, b, c)
+		}
+	})
+}
+
+func Example_sum() {
+	fmt.Println(sum())
+	fmt.Println(sum(1, 2, 3))
+	numbers := []int{10, 20, 30}
+	fmt.Println(sum(numbers...))
+	// Output:
+	// 0
+	// 6
+	// 60
+}
+
+func Example_divide() {
+	q, err := divide(7, 2)
+	fmt.Println(q, err)
+	_, err = divide(1, 0)
+	fmt.Println(err)
+	// Output:
+	// 3.5 <nil>
+	// division by zero
+}
+
+func ExampleFindMax() {
+	words := []string{"pear", "fig", "banana", "kiwi"}
+	longest := FindMax(words, func(a, b string) bool { return len(a) < len(b) })
+	fmt.Println(longest)
+	// Output: banana
+}
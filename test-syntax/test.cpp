@@ -1,3 +1,5 @@
+//go:build ignore
+
 // Single line comment
 /* Multi-line comment
    with multiple lines */
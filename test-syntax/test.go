@@ -5,16 +5,46 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
+	"flag"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"iter"
 	"log"
+	"log/slog"
+	"maps"
+	"math"
+	"math/big"
+	"math/rand"
+	"os"
+	"os/signal"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/yannickboog/zero-trust-theme/test-syntax/namehash"
 )
 
 // Constants
@@ -28,13 +58,30 @@ const (
 var (
 	globalCounter int
 	mu            sync.Mutex
-	ErrNotFound   = errors.New("item not found")
+	ErrNotFound   = NewNotFound("item not found", nil)
+	logger        = withBuildAttrs(slog.Default())
+
+	ErrDivisionByZero = errors.New("division by zero")
+	ErrIndeterminate  = errors.New("indeterminate result")
 )
 
 // Type definitions
 type UserID int64
 type Status string
 
+// Aliases (=) name an existing type; definitions create a new one.
+// Table is a generic alias (Go 1.24+).
+type (
+	PersonList                 = []Person
+	Table[K comparable, V any] = map[K]V
+	Duration                   = time.Duration // alias: keeps time.Duration's methods
+	Timeout                    time.Duration   // definition: new type, methods not inherited
+)
+
+func (t Timeout) String() string {
+	return "timeout after " + time.Duration(t).String()
+}
+
 // Enum-like constants
 const (
 	StatusActive   Status = "active"
@@ -42,16 +89,137 @@ const (
 	StatusPending  Status = "pending"
 )
 
+// Bit flags built from iota shifts
+type Permission uint8
+
+const (
+	PermRead Permission = 1 << iota
+	PermWrite
+	PermExecute
+	PermAdmin
+
+	PermNone Permission = 0
+	PermAll             = PermRead | PermWrite | PermExecute | PermAdmin
+)
+
+// Leaf function small enough to run without a stack-growth check
+//
+//go:nosplit
+func (p Permission) Has(flag Permission) bool {
+	return p&flag == flag
+}
+
+// Flag names joined with "|"; unknown bits are shown in hex
+func (p Permission) String() string {
+	if p == PermNone {
+		return "none"
+	}
+	var names []string
+	for flag := PermRead; flag <= PermAdmin; flag <<= 1 {
+		if p&flag == 0 {
+			continue
+		}
+		switch flag {
+		case PermRead:
+			names = append(names, "read")
+		case PermWrite:
+			names = append(names, "write")
+		case PermExecute:
+			names = append(names, "execute")
+		case PermAdmin:
+			names = append(names, "admin")
+		}
+	}
+	if rest := p &^ PermAll; rest != 0 {
+		names = append(names, fmt.Sprintf("%#x", uint8(rest)))
+	}
+	return strings.Join(names, "|")
+}
+
+// iota enum; the blank identifier skips zero so an unset Weekday is invalid.
+// String lives in the generated weekday_string.go.
+//
+//go:generate stringer -type=Weekday
+type Weekday int
+
+const (
+	_ Weekday = iota
+	Monday
+	Tuesday
+	Wednesday
+	Thursday
+	Friday
+	Saturday
+	Sunday
+)
+
+// Monday-first conversion from time.Weekday
+func weekdayOf(t time.Time) Weekday {
+	if wd := t.Weekday(); wd != time.Sunday {
+		return Weekday(wd)
+	}
+	return Sunday
+}
+
+// Untyped constants mixed with typed ones in constant expressions
+const (
+	bannerText    = "zero-trust"
+	bannerPadding = 2
+	bannerWidth   = len(bannerText) + 2*bannerPadding
+	workDays      = Friday - Monday + 1
+	workWeek      = time.Duration(workDays) * 8 * time.Hour
+)
+
+// Error codes surfaced in API responses
+const (
+	CodeNotFound = "not_found"
+	CodeInvalid  = "invalid"
+	CodeConflict = "conflict"
+)
+
+// Error type carrying an API code and an optional cause
+type CodedError struct {
+	Code    string
+	Message string
+	Err     error
+}
+
+func (e *CodedError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *CodedError) Unwrap() error {
+	return e.Err
+}
+
+// Constructor helpers, one per code
+func NewNotFound(message string, err error) *CodedError {
+	return &CodedError{Code: CodeNotFound, Message: message, Err: err}
+}
+
+func NewInvalid(message string, err error) *CodedError {
+	return &CodedError{Code: CodeInvalid, Message: message, Err: err}
+}
+
+func NewConflict(message string, err error) *CodedError {
+	return &CodedError{Code: CodeConflict, Message: message, Err: err}
+}
+
 // Struct with JSON tags
 type Person struct {
-	ID       UserID                 `json:"id"`
-	Name     string                 `json:"name"`
-	Age      int                    `json:"age"`
-	Email    *string                `json:"email,omitempty"`
-	Status   Status                 `json:"status"`
-	Created  time.Time              `json:"created"`
-	Tags     []string               `json:"tags"`
-	Metadata map[string]interface{} `json:"metadata"`
+	ID          UserID                 `json:"id"`
+	Name        string                 `json:"name"`
+	Age         int                    `json:"age"`
+	BirthDate   time.Time              `json:"birth_date,omitzero"`
+	Email       *string                `json:"email,omitempty"`
+	Status      Status                 `json:"status"`
+	Created     time.Time              `json:"created"`
+	Tags        []string               `json:"tags"`
+	Metadata    map[string]interface{} `json:"metadata"`
+	Permissions Permission             `json:"permissions,omitempty"`
 }
 
 // Method with receiver
@@ -65,8 +233,57 @@ func (p Person) IsAdult() bool {
 }
 
 // Method with pointer receiver
-func (p *Person) SetEmail(email string) {
+func (p *Person) SetEmail(email string) error {
+	if err := ValidateEmail(email); err != nil {
+		return err
+	}
 	p.Email = &email
+	return nil
+}
+
+// Validation method collecting field rules; the first failure is
+// returned as a *FieldError naming the JSON field
+func (p Person) Validate() error {
+	if p.ID < 0 {
+		return &FieldError{Field: "id", Err: fmt.Errorf("id %d is negative", p.ID)}
+	}
+	if strings.TrimSpace(p.Name) == "" {
+		return &FieldError{Field: "name", Err: errors.New("name is required")}
+	}
+	if !InRange(p.Age, 0, 150) {
+		return &FieldError{Field: "age", Err: fmt.Errorf("age %d out of range [0, 150]", p.Age)}
+	}
+	if p.Email != nil {
+		if err := ValidateEmail(*p.Email); err != nil {
+			return &FieldError{Field: "email", Err: err}
+		}
+	}
+	if !p.Status.Valid() {
+		return &FieldError{Field: "status", Err: fmt.Errorf("invalid status %q", p.Status)}
+	}
+	if rest := p.Permissions &^ PermAll; rest != 0 {
+		return &FieldError{Field: "permissions", Err: fmt.Errorf("unknown permission bits %#x", uint8(rest))}
+	}
+	return nil
+}
+
+// Standalone email rule shared by SetEmail and Validate
+func ValidateEmail(s string) error {
+	if s == "" {
+		return errors.New("email is empty")
+	}
+	local, domain, ok := strings.Cut(s, "@")
+	switch {
+	case !ok:
+		return fmt.Errorf("email %q is missing @", s)
+	case local == "":
+		return fmt.Errorf("email %q has an empty local part", s)
+	case domain == "":
+		return fmt.Errorf("email %q has an empty domain", s)
+	case strings.Contains(domain, "@"):
+		return fmt.Errorf("email %q has more than one @", s)
+	}
+	return nil
 }
 
 // String method for fmt.Stringer interface
@@ -74,84 +291,2825 @@ func (p Person) String() string {
 	return fmt.Sprintf("Person{ID: %d, Name: %s, Age: %d}", p.ID, p.Name, p.Age)
 }
 
-// Interface definition
-type Greeter interface {
-	Greet() string
+// Next anniversary of BirthDate on or after from's calendar day, in from's
+// location; Feb 29 birthdays fall on Mar 1 in non-leap years
+func (p Person) NextBirthday(from time.Time) (time.Time, error) {
+	if p.BirthDate.IsZero() {
+		return time.Time{}, errors.New("birth date not set")
+	}
+	today := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location())
+	next := p.birthdayIn(today.Year(), today.Location())
+	if next.Before(today) {
+		next = p.birthdayIn(today.Year()+1, today.Location())
+	}
+	return next, nil
 }
 
-// Interface with multiple methods
-type PersonManager interface {
-	Greeter
-	IsAdult() bool
-	SetEmail(string)
+func (p Person) birthdayIn(year int, loc *time.Location) time.Time {
+	month, day := p.BirthDate.Month(), p.BirthDate.Day()
+	leap := year%4 == 0 && (year%100 != 0 || year%400 == 0)
+	if month == time.February && day == 29 && !leap {
+		month, day = time.March, 1
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, loc)
 }
 
-// Embedded struct
-type Employee struct {
-	Person
-	Department string  `json:"department"`
-	Salary     float64 `json:"salary"`
+// Assets compiled into the binary: the whole seed directory as an FS,
+// and the greeting template as a plain string
+var (
+	//go:embed testdata/*.json
+	embeddedAssets embed.FS
+
+	//go:embed testdata/greeting.tmpl
+	greetingTemplate string
+)
+
+// Strictly decoded and validated people from the embedded seed file
+func LoadEmbeddedSeed() ([]Person, error) {
+	f, err := embeddedAssets.Open("testdata/seed.json")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var people []Person
+	err = DecodePeopleStream(f, DecodeOptions{Strict: true}, func(p Person) error {
+		people = append(people, p)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("embedded seed: %w", err)
+	}
+	return people, nil
 }
 
-// Method for embedded struct
-func (e *Employee) GetFullInfo() string {
-	return fmt.Sprintf("%s works in %s with salary $%.2f", e.Name, e.Department, e.Salary)
+// Names of the embedded seed files, via the generic fs.FS helpers
+func embeddedSeedFiles() ([]string, error) {
+	return fs.Glob(embeddedAssets, "testdata/*.json")
 }
 
-// Generic function (Go 1.18+)
-func FindMax[T comparable](items []T, less func(T, T) bool) T {
-	if len(items) == 0 {
-		var zero T
-		return zero
+// Helper funcs available to Render templates
+var renderFuncs = template.FuncMap{
+	"upper": strings.ToUpper,
+	// {{default "n/a" .Email}} yields the fallback for nil or empty values
+	"default": func(fallback, v interface{}) interface{} {
+		if v == nil {
+			return fallback
+		}
+		rv := reflect.ValueOf(v)
+		if (rv.Kind() == reflect.Pointer && rv.IsNil()) || rv.IsZero() {
+			return fallback
+		}
+		if rv.Kind() == reflect.Pointer {
+			return rv.Elem().Interface()
+		}
+		return v
+	},
+}
+
+// text/template rendering with the person as dot
+func (p Person) Render(tmpl string) (string, error) {
+	t, err := template.New("person").Funcs(renderFuncs).Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("parse template: %w", err)
 	}
+	var b strings.Builder
+	if err := t.Execute(&b, p); err != nil {
+		return "", fmt.Errorf("render template: %w", err)
+	}
+	return b.String(), nil
+}
 
-	max := items[0]
-	for _, item := range items[1:] {
-		if less(max, item) {
-			max = item
+// Deep copy: pointer, slice and nested metadata values are not shared
+func (p Person) Clone() Person {
+	if p.Email != nil {
+		email := *p.Email
+		p.Email = &email
+	}
+	if p.Tags != nil {
+		p.Tags = slices.Clone(p.Tags)
+	}
+	if p.Metadata != nil {
+		p.Metadata = cloneValue(p.Metadata).(map[string]interface{})
+	}
+	return p
+}
+
+// Functional update on a clone, leaving the receiver untouched
+func (p Person) CopyWith(mutate func(*Person)) Person {
+	c := p.Clone()
+	mutate(&c)
+	return c
+}
+
+// Stable JSON encoding: struct fields in declaration order, map keys sorted
+// by encoding/json, and times normalized to UTC so equal people hash alike
+func (p Person) MarshalCanonical() ([]byte, error) {
+	p.Created = p.Created.UTC()
+	p.BirthDate = p.BirthDate.UTC()
+	return json.Marshal(p)
+}
+
+// Hex SHA-256 of the canonical JSON; empty if the person cannot be encoded
+func (p Person) Checksum() string {
+	data, err := p.MarshalCanonical()
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func VerifyPerson(p Person, checksum string) bool {
+	sum := p.Checksum()
+	return sum != "" && sum == strings.ToLower(checksum)
+}
+
+// Display copy for low-privilege viewers: the email keeps only its first
+// character and domain (a***@example.com) and ip_address is dropped
+func (p Person) Masked() Person {
+	m := p.Clone()
+	if m.Email != nil {
+		masked := maskEmail(*m.Email)
+		m.Email = &masked
+	}
+	delete(m.Metadata, "ip_address")
+	return m
+}
+
+// Anything that does not look like local@domain is masked completely
+func maskEmail(email string) string {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" {
+		return "***"
+	}
+	_, size := utf8.DecodeRuneInString(local)
+	return local[:size] + "***@" + domain
+}
+
+// Recursive type switch over JSON-like values
+func cloneValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if v == nil {
+			return v
+		}
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[k] = cloneValue(val)
+		}
+		return m
+	case []interface{}:
+		if v == nil {
+			return v
 		}
+		s := make([]interface{}, len(v))
+		for i, val := range v {
+			s[i] = cloneValue(val)
+		}
+		return s
+	case []string:
+		return slices.Clone(v)
+	default:
+		return v
 	}
-	return max
 }
 
-// Function with multiple return values
-func divide(a, b float64) (float64, error) {
-	if b == 0 {
-		return 0, errors.New("division by zero")
+// Fuzzy match score in [0, 1]: weighted name similarity (normalized edit
+// distance), age equality, and email equality when both people have one
+func (p Person) SimilarTo(other Person) float64 {
+	const nameWeight, ageWeight, emailWeight = 0.6, 0.2, 0.2
+
+	score := nameWeight * nameSimilarity(p.Name, other.Name)
+	total := nameWeight + ageWeight
+	if p.Age == other.Age {
+		score += ageWeight
+	}
+	if p.Email != nil && other.Email != nil {
+		total += emailWeight
+		if strings.EqualFold(strings.TrimSpace(*p.Email), strings.TrimSpace(*other.Email)) {
+			score += emailWeight
+		}
 	}
-	return a / b, nil
+	return score / total
 }
 
-// Function with named return values
-func swap(x, y string) (first, second string) {
-	first = y
-	second = x
-	return // naked return
+func LikelyDuplicate(a, b Person, threshold float64) bool {
+	return a.SimilarTo(b) >= threshold
 }
 
-// Variadic function
-func sum(numbers ...int) int {
-	total := 0
-	for _, num := range numbers {
-		total += num
+// 1 minus the edit distance over the longer name, ignoring case and
+// surrounding space; two blank names count as identical
+func nameSimilarity(a, b string) float64 {
+	ra := []rune(strings.ToLower(strings.TrimSpace(a)))
+	rb := []rune(strings.ToLower(strings.TrimSpace(b)))
+	longest := max(len(ra), len(rb))
+	if longest == 0 {
+		return 1
 	}
-	return total
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+// Edit distance with a single rolling row
+func levenshtein(a, b []rune) int {
+	row := make([]int, len(b)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		prev := row[0]
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			prev, row[j] = row[j], min(row[j]+1, row[j-1]+1, prev+cost)
+		}
+	}
+	return row[len(b)]
+}
+
+// Options shared by every Person decoding entry point
+type DecodeOptions struct {
+	Strict        bool // reject unknown fields instead of dropping them
+	CoerceNumbers bool // accept string-encoded numbers for id and age
+}
+
+// Error attributed to a single (dotted) JSON field path
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("field %q: %v", e.Field, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Keys strict decoding requires to be present and non-null; a zero value
+// for them must be stated, not implied
+var requiredPersonFields = []string{"id", "name", "age", "status"}
+
+// Decoding of a single JSON object; trailing data is always rejected
+func DecodePerson(data []byte, opts DecodeOptions) (Person, error) {
+	if opts.CoerceNumbers {
+		var err error
+		if data, err = coerceNumberFields(data, "id", "age"); err != nil {
+			return Person{}, err
+		}
+	}
+	if opts.Strict {
+		if err := checkRequiredFields(data, requiredPersonFields...); err != nil {
+			return Person{}, err
+		}
+	}
+	var p Person
+	dec := newPersonDecoder(bytes.NewReader(data), opts)
+	if err := dec.Decode(&p); err != nil {
+		var parseErr *time.ParseError
+		if errors.As(err, &parseErr) {
+			err = timeFieldError(data, err, "created", "birth_date")
+		}
+		return Person{}, decodeError(err)
+	}
+	if dec.More() {
+		return Person{}, NewInvalid("decode person", errors.New("unexpected data after object"))
+	}
+	return p, nil
+}
+
+// Strict decoding: unknown keys and trailing data are rejected
+func StrictDecodePerson(data []byte) (Person, error) {
+	return DecodePerson(data, DecodeOptions{Strict: true})
+}
+
+func newPersonDecoder(r io.Reader, opts DecodeOptions) *json.Decoder {
+	dec := json.NewDecoder(r)
+	if opts.Strict {
+		dec.DisallowUnknownFields()
+	}
+	return dec
+}
+
+// Missing or null required keys; anything that isn't an object is left
+// for the regular decoder to reject
+func checkRequiredFields(data []byte, names ...string) error {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(data, &fields) != nil {
+		return nil
+	}
+	for _, name := range names {
+		if raw, ok := fields[name]; !ok || string(raw) == "null" {
+			return NewInvalid("decode person", &FieldError{Field: name, Err: errors.New("is required")})
+		}
+	}
+	return nil
+}
+
+// encoding/json reports a bad timestamp as a bare *time.ParseError; find
+// which of the time fields failed so the error can name it
+func timeFieldError(data []byte, err error, names ...string) error {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(data, &fields) != nil {
+		return err
+	}
+	for _, name := range names {
+		raw, ok := fields[name]
+		if !ok {
+			continue
+		}
+		var t time.Time
+		if json.Unmarshal(raw, &t) != nil {
+			return &FieldError{Field: name, Err: err}
+		}
+	}
+	return err
+}
+
+// Rewrites top-level string values like "age":"30" into JSON numbers;
+// anything that isn't an object is left for the regular decoder to reject
+func coerceNumberFields(data []byte, names ...string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(data, &fields) != nil {
+		return data, nil
+	}
+	changed := false
+	for _, name := range names {
+		raw, ok := fields[name]
+		var s string
+		if !ok || json.Unmarshal(raw, &s) != nil {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil {
+			return nil, NewInvalid("decode person", &FieldError{Field: name, Err: fmt.Errorf("%q is not a number", s)})
+		}
+		fields[name] = json.RawMessage(strconv.FormatInt(n, 10))
+		changed = true
+	}
+	if !changed {
+		return data, nil
+	}
+	return json.Marshal(fields)
+}
+
+// Maps encoding/json errors onto invalid CodedErrors naming the field
+func decodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		err = &FieldError{Field: typeErr.Field, Err: fmt.Errorf("cannot use JSON %s as %s", typeErr.Value, typeErr.Type)}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no typed error for unknown fields
+		name, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		err = &FieldError{Field: name, Err: errors.New("unknown field")}
+	}
+	return NewInvalid("decode person", err)
+}
+
+// Flat env-style export. Tags are comma-joined, quoting any tag that is
+// empty or holds a comma or leading quote; Metadata is JSON-encoded. Nil
+// Tags and Metadata leave their keys out, so empty and nil survive the
+// round trip.
+func (p Person) ToEnv(prefix string) (map[string]string, error) {
+	env := map[string]string{
+		prefix + "_ID":     strconv.FormatInt(int64(p.ID), 10),
+		prefix + "_NAME":   p.Name,
+		prefix + "_AGE":    strconv.Itoa(p.Age),
+		prefix + "_STATUS": string(p.Status),
+	}
+	if p.Tags != nil {
+		env[prefix+"_TAGS"] = joinEnvList(p.Tags)
+	}
+	if p.Metadata != nil {
+		data, err := json.Marshal(p.Metadata)
+		if err != nil {
+			return nil, NewInvalid(prefix+"_METADATA", err)
+		}
+		env[prefix+"_METADATA"] = string(data)
+	}
+	if p.Email != nil {
+		env[prefix+"_EMAIL"] = *p.Email
+	}
+	if !p.Created.IsZero() {
+		env[prefix+"_CREATED"] = p.Created.Format(time.RFC3339Nano)
+	}
+	if !p.BirthDate.IsZero() {
+		env[prefix+"_BIRTH_DATE"] = p.BirthDate.Format(time.DateOnly)
+	}
+	if p.Permissions != PermNone {
+		env[prefix+"_PERMISSIONS"] = strconv.FormatUint(uint64(p.Permissions), 10)
+	}
+	return env, nil
+}
+
+// "a", "b,c", "" -> a,"b,c",""
+func joinEnvList(items []string) string {
+	quoted := make([]string, len(items))
+	for i, item := range items {
+		if item == "" || strings.ContainsRune(item, ',') || strings.HasPrefix(item, `"`) {
+			item = strconv.Quote(item)
+		}
+		quoted[i] = item
+	}
+	return strings.Join(quoted, ",")
+}
+
+// Inverse of joinEnvList; "" is an empty, non-nil list
+func splitEnvList(s string) ([]string, error) {
+	items := []string{}
+	if s == "" {
+		return items, nil
+	}
+	for {
+		var item string
+		if strings.HasPrefix(s, `"`) {
+			quoted, err := strconv.QuotedPrefix(s)
+			if err != nil {
+				return nil, err
+			}
+			item, _ = strconv.Unquote(quoted)
+			s = s[len(quoted):]
+			if s != "" && s[0] != ',' {
+				return nil, fmt.Errorf("unexpected %q after quoted item", s)
+			}
+		} else {
+			item, _, _ = strings.Cut(s, ",")
+			s = s[len(item):]
+		}
+		items = append(items, item)
+		if s == "" {
+			return items, nil
+		}
+		s = s[1:] // the comma
+	}
+}
+
+// Inverse of ToEnv
+func PersonFromEnv(prefix string, env map[string]string) (Person, error) {
+	var p Person
+	if v, ok := env[prefix+"_ID"]; ok {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return Person{}, NewInvalid(prefix+"_ID", err)
+		}
+		p.ID = UserID(id)
+	}
+	if v, ok := env[prefix+"_AGE"]; ok {
+		age, err := strconv.Atoi(v)
+		if err != nil {
+			return Person{}, NewInvalid(prefix+"_AGE", err)
+		}
+		p.Age = age
+	}
+	if v, ok := env[prefix+"_CREATED"]; ok {
+		created, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return Person{}, NewInvalid(prefix+"_CREATED", err)
+		}
+		p.Created = created
+	}
+	if v, ok := env[prefix+"_BIRTH_DATE"]; ok {
+		birthDate, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			return Person{}, NewInvalid(prefix+"_BIRTH_DATE", err)
+		}
+		p.BirthDate = birthDate
+	}
+	if v, ok := env[prefix+"_PERMISSIONS"]; ok {
+		perms, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			return Person{}, NewInvalid(prefix+"_PERMISSIONS", err)
+		}
+		p.Permissions = Permission(perms)
+	}
+	if v, ok := env[prefix+"_EMAIL"]; ok {
+		p.Email = &v
+	}
+	if v, ok := env[prefix+"_TAGS"]; ok {
+		tags, err := splitEnvList(v)
+		if err != nil {
+			return Person{}, NewInvalid(prefix+"_TAGS", err)
+		}
+		p.Tags = tags
+	}
+	if v, ok := env[prefix+"_METADATA"]; ok {
+		if err := json.Unmarshal([]byte(v), &p.Metadata); err != nil {
+			return Person{}, NewInvalid(prefix+"_METADATA", err)
+		}
+	}
+	p.Name = env[prefix+"_NAME"]
+	p.Status = Status(env[prefix+"_STATUS"])
+	return p, nil
+}
+
+// Streaming decode of a top-level JSON array (or NDJSON, detected from the
+// first non-space byte), one validated element at a time so memory stays
+// flat regardless of input size. NDJSON errors carry line numbers.
+func DecodePeopleStream(r io.Reader, opts DecodeOptions, fn func(Person) error) error {
+	br := bufio.NewReader(r)
+	first, err := peekNonSpace(br)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if first != '[' {
+		i := 0
+		for p, err := range DecodeNDJSON(br, opts) {
+			if err != nil {
+				return err
+			}
+			if err := fn(p); err != nil {
+				return fmt.Errorf("element %d: %w", i, err)
+			}
+			i++
+		}
+		return nil
+	}
+
+	// Elements go through DecodePerson so every option, CoerceNumbers
+	// included, applies exactly as it does to single objects
+	dec := json.NewDecoder(br)
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	for i := 0; dec.More(); i++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return fmt.Errorf("element %d: %w", i, decodeError(err))
+		}
+		p, err := DecodePerson(raw, opts)
+		if err != nil {
+			return fmt.Errorf("element %d: %w", i, err)
+		}
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("element %d: %w", i, NewInvalid("invalid person", err))
+		}
+		if err := fn(p); err != nil {
+			return fmt.Errorf("element %d: %w", i, err)
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("end of array: %w", err)
+	}
+	return nil
+}
+
+// Validation-only batch check: errs[i] is nil when payloads[i] strictly
+// decodes to a valid Person, so results stay aligned with the input
+func ValidatePeopleJSON(payloads [][]byte) []error {
+	errs := make([]error, len(payloads))
+	for i, data := range payloads {
+		p, err := StrictDecodePerson(data)
+		if err == nil {
+			if verr := p.Validate(); verr != nil {
+				err = NewInvalid("invalid person", verr)
+			}
+		}
+		if err != nil {
+			errs[i] = fmt.Errorf("payload %d: %w", i, err)
+		}
+	}
+	return errs
+}
+
+// Newline-delimited JSON writer, one record per line
+func EncodeNDJSON(w io.Writer, seq iter.Seq[Person]) error {
+	enc := json.NewEncoder(w)
+	for p := range seq {
+		if err := enc.Encode(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Newline-delimited JSON reader; blank lines are ignored and errors carry
+// the 1-based line number. Iteration stops after the first error.
+// Enveloped records are verified and unwrapped transparently.
+func DecodeNDJSON(r io.Reader, opts DecodeOptions) iter.Seq2[Person, error] {
+	return decodeNDJSON(r, opts, nil)
+}
+
+// Lenient variant: malformed or invalid lines are skipped and counted in
+// *skipped instead of ending the iteration; read errors still stop it
+func DecodeNDJSONSkipInvalid(r io.Reader, opts DecodeOptions, skipped *int) iter.Seq2[Person, error] {
+	return decodeNDJSON(r, opts, skipped)
+}
+
+func decodeNDJSON(r io.Reader, opts DecodeOptions, skipped *int) iter.Seq2[Person, error] {
+	return func(yield func(Person, error) bool) {
+		br := bufio.NewReader(r)
+		for line := 1; ; line++ {
+			raw, readErr := br.ReadBytes('\n')
+			if readErr != nil && readErr != io.EOF {
+				yield(Person{}, fmt.Errorf("line %d: %w", line, readErr))
+				return
+			}
+
+			if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && !bytes.HasPrefix(trimmed, trailerPrefix) {
+				var p Person
+				payload, err := openEnvelope(trimmed)
+				if err == nil {
+					p, err = DecodePerson(payload, opts)
+				}
+				if err == nil {
+					if verr := p.Validate(); verr != nil {
+						err = NewInvalid("invalid person", verr)
+					}
+				}
+				switch {
+				case err == nil:
+					if !yield(p, nil) {
+						return
+					}
+				case skipped != nil:
+					*skipped++
+				default:
+					yield(Person{}, fmt.Errorf("line %d: %w", line, err))
+					return
+				}
+			}
+
+			if readErr == io.EOF {
+				return
+			}
+		}
+	}
+}
+
+// Integrity envelopes for NDJSON exports: every record line is wrapped as
+// {"checksum":"crc32c:…","payload":{…}} and a final trailer line records
+// the record count and a SHA-256 over all payloads, so truncation and
+// corruption are both detectable
+type envelope struct {
+	Checksum string           `json:"checksum,omitempty"`
+	Payload  json.RawMessage  `json:"payload,omitempty"`
+	Trailer  *envelopeTrailer `json:"trailer,omitempty"`
+}
+
+type envelopeTrailer struct {
+	Count int    `json:"count"`
+	Hash  string `json:"hash"`
+}
+
+// Line prefixes written by WriteEnveloped, used to sniff enveloped input
+var (
+	envelopePrefix = []byte(`{"checksum":`)
+	trailerPrefix  = []byte(`{"trailer":`)
+)
+
+// Number of mismatches kept in a VerifyReport
+const maxReportedMismatches = 10
+
+func recordChecksum(payload []byte) string {
+	return fmt.Sprintf("crc32c:%08x", crc32.Checksum(payload, castagnoli))
+}
+
+func WriteEnveloped(w io.Writer, seq iter.Seq[Person]) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	rolling := sha256.New()
+	count := 0
+	for p := range seq {
+		payload, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		rolling.Write(payload)
+		if err := enc.Encode(envelope{Checksum: recordChecksum(payload), Payload: payload}); err != nil {
+			return err
+		}
+		count++
+	}
+	trailer := &envelopeTrailer{Count: count, Hash: "sha256:" + hex.EncodeToString(rolling.Sum(nil))}
+	if err := enc.Encode(envelope{Trailer: trailer}); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Single integrity problem, by 1-based line number
+type Mismatch struct {
+	Line   int
+	Reason string
+}
+
+// Result of VerifyEnveloped; Mismatches holds at most the first
+// maxReportedMismatches problems, Corrupt counts all of them
+type VerifyReport struct {
+	Records    int
+	Corrupt    int
+	Mismatches []Mismatch
+	TrailerOK  bool
+}
+
+func (r VerifyReport) OK() bool {
+	return r.Corrupt == 0 && r.TrailerOK
+}
+
+func (r *VerifyReport) mismatch(line int, reason string) {
+	r.Corrupt++
+	if len(r.Mismatches) < maxReportedMismatches {
+		r.Mismatches = append(r.Mismatches, Mismatch{Line: line, Reason: reason})
+	}
+}
+
+// Checks every record checksum and the trailer; the error is reserved for
+// read failures, integrity problems are reported in the VerifyReport
+func VerifyEnveloped(r io.Reader) (VerifyReport, error) {
+	var report VerifyReport
+	br := bufio.NewReader(r)
+	rolling := sha256.New()
+	seenTrailer := false
+	for line := 1; ; line++ {
+		raw, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return report, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 {
+			var env envelope
+			switch {
+			case seenTrailer:
+				report.mismatch(line, "data after trailer")
+			case json.Unmarshal(trimmed, &env) != nil:
+				report.mismatch(line, "malformed envelope")
+			case env.Trailer != nil:
+				seenTrailer = true
+				hash := "sha256:" + hex.EncodeToString(rolling.Sum(nil))
+				switch {
+				case env.Trailer.Count != report.Records:
+					report.mismatch(line, fmt.Sprintf("trailer count %d, found %d records", env.Trailer.Count, report.Records))
+				case env.Trailer.Hash != hash:
+					report.mismatch(line, "trailer hash mismatch")
+				default:
+					report.TrailerOK = true
+				}
+			default:
+				report.Records++
+				rolling.Write(env.Payload)
+				if recordChecksum(env.Payload) != env.Checksum {
+					report.mismatch(line, "checksum mismatch")
+				}
+			}
+		}
+
+		if err == io.EOF {
+			if !seenTrailer {
+				report.mismatch(line, "missing trailer (truncated input?)")
+			}
+			return report, nil
+		}
+	}
+}
+
+// Unwraps an enveloped line after checking its checksum; plain lines are
+// returned unchanged
+func openEnvelope(line []byte) ([]byte, error) {
+	if !bytes.HasPrefix(line, envelopePrefix) {
+		return line, nil
+	}
+	var env envelope
+	if err := json.Unmarshal(line, &env); err != nil {
+		return nil, err
+	}
+	if recordChecksum(env.Payload) != env.Checksum {
+		return nil, NewInvalid("checksum mismatch", nil)
+	}
+	return env.Payload, nil
+}
+
+// Person variant for proxying: Metadata keeps the input bytes, so number
+// formatting and key order survive (encoding/json still compacts
+// whitespace when marshaling)
+type PersonRaw struct {
+	ID          UserID          `json:"id"`
+	Name        string          `json:"name"`
+	Age         int             `json:"age"`
+	BirthDate   time.Time       `json:"birth_date,omitzero"`
+	Email       *string         `json:"email,omitempty"`
+	Status      Status          `json:"status"`
+	Created     time.Time       `json:"created"`
+	Tags        []string        `json:"tags"`
+	Metadata    json.RawMessage `json:"metadata"`
+	Permissions Permission      `json:"permissions,omitempty"`
+}
+
+// Metadata is only checked to be a JSON object (or null)
+func (p *PersonRaw) UnmarshalJSON(data []byte) error {
+	// Method-free copy of the struct, so decoding doesn't recurse
+	type fields PersonRaw
+	var f fields
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	if trimmed := bytes.TrimSpace(f.Metadata); len(trimmed) > 0 && trimmed[0] != '{' && string(trimmed) != "null" {
+		return NewInvalid("decode person", &FieldError{Field: "metadata", Err: errors.New("not a JSON object")})
+	}
+	*p = PersonRaw(f)
+	return nil
+}
+
+// Conversions between the raw and typed representations
+func NewPersonRaw(p Person) (PersonRaw, error) {
+	metadata, err := json.Marshal(p.Metadata)
+	if err != nil {
+		return PersonRaw{}, err
+	}
+	return PersonRaw{
+		ID:          p.ID,
+		Name:        p.Name,
+		Age:         p.Age,
+		BirthDate:   p.BirthDate,
+		Email:       p.Email,
+		Status:      p.Status,
+		Created:     p.Created,
+		Tags:        p.Tags,
+		Metadata:    metadata,
+		Permissions: p.Permissions,
+	}, nil
+}
+
+func (p PersonRaw) ToPerson() (Person, error) {
+	person := Person{
+		ID:          p.ID,
+		Name:        p.Name,
+		Age:         p.Age,
+		BirthDate:   p.BirthDate,
+		Email:       p.Email,
+		Status:      p.Status,
+		Created:     p.Created,
+		Tags:        p.Tags,
+		Permissions: p.Permissions,
+	}
+	if len(p.Metadata) > 0 {
+		if err := json.Unmarshal(p.Metadata, &person.Metadata); err != nil {
+			return Person{}, NewInvalid("decode person", &FieldError{Field: "metadata", Err: err})
+		}
+	}
+	return person, nil
+}
+
+// Field-name casing for JSON consumers that don't follow our snake_case tags
+type Casing int
+
+const (
+	SnakeCase Casing = iota
+	CamelCase
+)
+
+// Encodes v with encoding/json, so embedding and omitempty behave exactly
+// as usual, then re-keys struct field names into the requested casing,
+// keeping key order. Map keys, such as those in Metadata, are left as is.
+func EncodeJSONWithCasing(v any, casing Casing) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if casing == SnakeCase {
+		return data, nil
+	}
+	return rekeyJSON(data, reflect.TypeOf(v), keyMapping{in: identity[string], out: snakeToCamel})
+}
+
+// Inverse of EncodeJSONWithCasing for payloads sent in the given casing
+func DecodeJSONWithCasing(data []byte, v any, casing Casing) error {
+	if casing != SnakeCase {
+		var err error
+		if data, err = rekeyJSON(data, reflect.TypeOf(v), keyMapping{in: snakeToCamel, out: identity[string]}); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(data, v)
+}
+
+// How a field's tag name appears in the input and should appear in the
+// output
+type keyMapping struct {
+	in, out func(string) string
+}
+
+func identity[T any](v T) T { return v }
+
+var (
+	jsonMarshalerType   = reflect.TypeFor[json.Marshaler]()
+	jsonUnmarshalerType = reflect.TypeFor[json.Unmarshaler]()
+)
+
+// Rewrites the keys of objects that encode structs of type t, guided by
+// the type rather than the data: map keys, interface values and types
+// with their own JSON methods pass through untouched, as do numbers
+func rekeyJSON(data []byte, t reflect.Type, keys keyMapping) ([]byte, error) {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	trimmed := bytes.TrimSpace(data)
+	if t == nil || len(trimmed) == 0 || trimmed[0] == 'n' ||
+		t.Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(jsonUnmarshalerType) {
+		return data, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		fields := jsonFieldTypes(t)
+		byInput := make(map[string]string, len(fields))
+		for name := range fields {
+			byInput[keys.in(name)] = name
+		}
+		return rekeyObject(trimmed, func(key string) (string, reflect.Type) {
+			name, ok := byInput[key]
+			if !ok {
+				return key, nil
+			}
+			return keys.out(name), fields[name]
+		}, keys)
+	case reflect.Map:
+		return rekeyObject(trimmed, func(key string) (string, reflect.Type) {
+			return key, t.Elem()
+		}, keys)
+	case reflect.Slice, reflect.Array:
+		if trimmed[0] != '[' {
+			return data, nil // []byte encodes as a string
+		}
+		var items []json.RawMessage
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		buf.WriteByte('[')
+		for i, item := range items {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			b, err := rekeyJSON(item, t.Elem(), keys)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(b)
+		}
+		buf.WriteByte(']')
+		return buf.Bytes(), nil
+	default:
+		return data, nil
+	}
+}
+
+// Re-keys one object in input order; field reports the output key and
+// the value's type for each input key
+func rekeyObject(data []byte, field func(key string) (string, reflect.Type), keys keyMapping) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('{') {
+		return nil, fmt.Errorf("rekey: expected an object, got %v", tok)
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		out, t := field(key)
+		if value, err = rekeyJSON(value, t, keys); err != nil {
+			return nil, err
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(out)
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// JSON names of t's fields with their types, promoting untagged embedded
+// structs the way encoding/json does; a shallower field wins a name clash
+func jsonFieldTypes(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	var promoted []map[string]reflect.Type
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			et := f.Type
+			if et.Kind() == reflect.Pointer {
+				et = et.Elem()
+			}
+			if et.Kind() == reflect.Struct {
+				promoted = append(promoted, jsonFieldTypes(et))
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	for _, inner := range promoted {
+		for name, ft := range inner {
+			if _, ok := fields[name]; !ok {
+				fields[name] = ft
+			}
+		}
+	}
+	return fields
+}
+
+// "last_login" -> "lastLogin"
+func snakeToCamel(s string) string {
+	parts := strings.Split(s, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// "lastLogin" -> "last_login", "userID" -> "user_id"
+func camelToSnake(s string) string {
+	runes := []rune(s)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				(i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Peek helper skipping leading whitespace without consuming the next byte
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b, br.UnreadByte()
+	}
+}
+
+// XML wire shapes for the partner integration
+type xmlPerson struct {
+	ID          UserID     `xml:"id,attr"`
+	Name        string     `xml:"name"`
+	Age         int        `xml:"age"`
+	BirthDate   string     `xml:"birth_date,omitempty"`
+	Email       *string    `xml:"email,omitempty"`
+	Status      Status     `xml:"status"`
+	Created     string     `xml:"created,omitempty"`
+	Tags        []string   `xml:"tags>tag"`
+	Metadata    []xmlEntry `xml:"metadata>entry"`
+	Permissions Permission `xml:"permissions,omitempty"`
+}
+
+type xmlEntry struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+type xmlEmployee struct {
+	Person     Person  `xml:"person"`
+	Department string  `xml:"department"`
+	Salary     float64 `xml:"salary"`
+}
+
+// Custom XML encoding: <person id="…"> with RFC 3339 times and metadata as
+// key-sorted <entry> elements. Metadata values are written with fmt and
+// decode back as strings.
+func (p Person) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	x := xmlPerson{
+		ID:          p.ID,
+		Name:        p.Name,
+		Age:         p.Age,
+		Email:       p.Email,
+		Status:      p.Status,
+		Tags:        p.Tags,
+		Permissions: p.Permissions,
+	}
+	if !p.Created.IsZero() {
+		x.Created = p.Created.Format(time.RFC3339)
+	}
+	if !p.BirthDate.IsZero() {
+		x.BirthDate = p.BirthDate.Format(time.DateOnly)
+	}
+	keys := make([]string, 0, len(p.Metadata))
+	for k := range p.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		x.Metadata = append(x.Metadata, xmlEntry{Key: k, Value: fmt.Sprint(p.Metadata[k])})
+	}
+
+	start.Name = xml.Name{Local: "person"}
+	return e.EncodeElement(x, start)
+}
+
+func (p *Person) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var x xmlPerson
+	if err := d.DecodeElement(&x, &start); err != nil {
+		return err
+	}
+	if !x.Status.Valid() {
+		return NewInvalid("decode person", fmt.Errorf("invalid status %q", x.Status))
+	}
+
+	*p = Person{
+		ID:          x.ID,
+		Name:        x.Name,
+		Age:         x.Age,
+		Email:       x.Email,
+		Status:      x.Status,
+		Tags:        x.Tags,
+		Permissions: x.Permissions,
+	}
+	if x.Created != "" {
+		created, err := time.Parse(time.RFC3339, x.Created)
+		if err != nil {
+			return NewInvalid("decode person", err)
+		}
+		p.Created = created
+	}
+	if x.BirthDate != "" {
+		birthDate, err := time.Parse(time.DateOnly, x.BirthDate)
+		if err != nil {
+			return NewInvalid("decode person", err)
+		}
+		p.BirthDate = birthDate
+	}
+	if len(x.Metadata) > 0 {
+		p.Metadata = make(map[string]interface{}, len(x.Metadata))
+		for _, entry := range x.Metadata {
+			p.Metadata[entry.Key] = entry.Value
+		}
+	}
+	return nil
+}
+
+// Employee needs its own methods: the promoted Person ones would drop the
+// employee fields. The person is nested, not flattened.
+func (e Employee) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	start.Name = xml.Name{Local: "employee"}
+	return enc.EncodeElement(xmlEmployee{Person: e.Person, Department: e.Department, Salary: e.Salary}, start)
+}
+
+func (e *Employee) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var x xmlEmployee
+	if err := d.DecodeElement(&x, &start); err != nil {
+		return err
+	}
+	*e = Employee{Person: x.Person, Department: x.Department, Salary: x.Salary}
+	return nil
+}
+
+// Compact binary format: a version byte followed by length-prefixed fields
+// in a fixed order. Decoders skip trailing fields they don't know, so new
+// fields can be appended without breaking older readers.
+const binaryVersion = 1
+
+// Upper bound for a single framed record, guarding allocations on decode
+const maxBinaryRecord = 16 << 20
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Satisfies encoding.BinaryMarshaler
+func (p Person) MarshalBinary() ([]byte, error) {
+	created, err := p.Created.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	birthDate, err := p.BirthDate.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	var metadata []byte
+	if p.Metadata != nil {
+		// encoding/json sorts map keys, so this is canonical
+		if metadata, err = json.Marshal(p.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	email := []byte{0}
+	if p.Email != nil {
+		email = append([]byte{1}, *p.Email...)
+	}
+	var tags []byte
+	tags = binary.AppendUvarint(tags, uint64(len(p.Tags)))
+	for _, tag := range p.Tags {
+		tags = binary.AppendUvarint(tags, uint64(len(tag)))
+		tags = append(tags, tag...)
+	}
+
+	buf := []byte{binaryVersion}
+	for _, field := range [][]byte{
+		binary.AppendVarint(nil, int64(p.ID)),
+		[]byte(p.Name),
+		binary.AppendVarint(nil, int64(p.Age)),
+		email,
+		[]byte(p.Status),
+		created,
+		tags,
+		metadata,
+		birthDate,             // added after version 1 shipped, so optional on decode
+		{byte(p.Permissions)}, // likewise optional
+	} {
+		buf = binary.AppendUvarint(buf, uint64(len(field)))
+		buf = append(buf, field...)
+	}
+	return buf, nil
+}
+
+// Satisfies encoding.BinaryUnmarshaler
+func (p *Person) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("binary person: empty input")
+	}
+	if data[0] != binaryVersion {
+		return fmt.Errorf("binary person: unsupported version %d", data[0])
+	}
+	rest := data[1:]
+	next := func() ([]byte, error) {
+		n, size := binary.Uvarint(rest)
+		if size <= 0 {
+			return nil, errors.New("binary person: bad field length")
+		}
+		if n > uint64(len(rest)-size) {
+			return nil, errors.New("binary person: field length exceeds input")
+		}
+		field := rest[size : size+int(n)]
+		rest = rest[size+int(n):]
+		return field, nil
+	}
+	varint := func(field []byte) (int64, error) {
+		v, size := binary.Varint(field)
+		if size <= 0 || size != len(field) {
+			return 0, errors.New("binary person: bad varint")
+		}
+		return v, nil
+	}
+
+	var fields [8][]byte
+	for i := range fields {
+		field, err := next()
+		if err != nil {
+			return err
+		}
+		fields[i] = field
+	}
+	// Optional fields, then any appended by newer writers
+	var birthDate, perms []byte
+	for _, opt := range []*[]byte{&birthDate, &perms} {
+		if len(rest) == 0 {
+			break
+		}
+		field, err := next()
+		if err != nil {
+			return err
+		}
+		*opt = field
+	}
+	for len(rest) > 0 {
+		if _, err := next(); err != nil {
+			return err
+		}
+	}
+
+	var out Person
+	id, err := varint(fields[0])
+	if err != nil {
+		return err
+	}
+	age, err := varint(fields[2])
+	if err != nil {
+		return err
+	}
+	out.ID, out.Name, out.Age = UserID(id), string(fields[1]), int(age)
+
+	switch email := fields[3]; {
+	case len(email) == 0:
+		return errors.New("binary person: bad email field")
+	case email[0] == 1:
+		s := string(email[1:])
+		out.Email = &s
+	}
+	out.Status = Status(fields[4])
+	if err := out.Created.UnmarshalBinary(fields[5]); err != nil {
+		return fmt.Errorf("binary person: created: %w", err)
+	}
+
+	tags := fields[6]
+	count, size := binary.Uvarint(tags)
+	// Each tag needs at least one length byte, which bounds the allocation
+	if size <= 0 || count > uint64(len(tags)-size) {
+		return errors.New("binary person: bad tag count")
+	}
+	tags = tags[size:]
+	out.Tags = make([]string, 0, count)
+	for i := uint64(0); i < count; i++ {
+		n, size := binary.Uvarint(tags)
+		if size <= 0 || n > uint64(len(tags)-size) {
+			return errors.New("binary person: bad tag length")
+		}
+		out.Tags = append(out.Tags, string(tags[size:size+int(n)]))
+		tags = tags[size+int(n):]
+	}
+
+	if birthDate != nil {
+		if err := out.BirthDate.UnmarshalBinary(birthDate); err != nil {
+			return fmt.Errorf("binary person: birth date: %w", err)
+		}
+	}
+	if perms != nil {
+		if len(perms) != 1 {
+			return errors.New("binary person: bad permissions field")
+		}
+		out.Permissions = Permission(perms[0])
+	}
+	if len(fields[7]) > 0 {
+		if err := json.Unmarshal(fields[7], &out.Metadata); err != nil {
+			return fmt.Errorf("binary person: metadata: %w", err)
+		}
+	}
+	*p = out
+	return nil
+}
+
+// Batch framing: each record is written as a uvarint length, the record
+// bytes and a big-endian CRC-32C of those bytes
+func EncodeBatch(w io.Writer, people []Person) error {
+	bw := bufio.NewWriter(w)
+	for _, p := range people {
+		record, err := p.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		frame := binary.AppendUvarint(nil, uint64(len(record)))
+		frame = append(frame, record...)
+		frame = binary.BigEndian.AppendUint32(frame, crc32.Checksum(record, castagnoli))
+		if _, err := bw.Write(frame); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func DecodeBatch(r io.Reader) ([]Person, error) {
+	br := bufio.NewReader(r)
+	var people []Person
+	for i := 0; ; i++ {
+		n, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return people, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", i, err)
+		}
+		if n > maxBinaryRecord {
+			return nil, fmt.Errorf("record %d: length %d exceeds limit", i, n)
+		}
+
+		// Read through a limit instead of allocating n+4 up front, so a
+		// forged length costs no more memory than the input really holds
+		frame, err := io.ReadAll(io.LimitReader(br, int64(n)+4))
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", i, err)
+		}
+		if uint64(len(frame)) != n+4 {
+			return nil, fmt.Errorf("record %d: %w", i, io.ErrUnexpectedEOF)
+		}
+		record, sum := frame[:n], binary.BigEndian.Uint32(frame[n:])
+		if crc32.Checksum(record, castagnoli) != sum {
+			return nil, fmt.Errorf("record %d: checksum mismatch", i)
+		}
+
+		var p Person
+		if err := p.UnmarshalBinary(record); err != nil {
+			return nil, fmt.Errorf("record %d: %w", i, err)
+		}
+		people = append(people, p)
+	}
+}
+
+// Method on a named string type
+func (s Status) Valid() bool {
+	switch s {
+	case StatusActive, StatusInactive, StatusPending:
+		return true
+	}
+	return false
+}
+
+// Interface definition
+type Greeter interface {
+	Greet() string
+}
+
+// Interface with multiple methods
+type PersonManager interface {
+	Greeter
+	IsAdult() bool
+	SetEmail(string) error
+}
+
+// Embedded struct
+type Employee struct {
+	Person
+	Department string  `json:"department"`
+	Salary     float64 `json:"salary"`
+}
+
+// Method for embedded struct; en-US formatting
+func (e *Employee) GetFullInfo() string {
+	return e.FormatInfo("en-US")
+}
+
+// Number and date conventions per locale
+type localeFormat struct {
+	group, decimal string
+	currencyPrefix string
+	currencySuffix string
+	date           string // time layout
+}
+
+var localeFormats = Table[string, localeFormat]{
+	"en-US": {group: ",", decimal: ".", currencyPrefix: "$", date: "01/02/2006"},
+	"de-DE": {group: ".", decimal: ",", currencySuffix: " €", date: "02.01.2006"},
+}
+
+// Like GetFullInfo with the salary and start date formatted for loc;
+// unknown locales fall back to en-US. Only the numbers are localized.
+func (e Employee) FormatInfo(loc string) string {
+	lf, ok := localeFormats[loc]
+	if !ok {
+		lf = localeFormats["en-US"]
+	}
+	info := fmt.Sprintf("%s works in %s with salary %s", e.Name, e.Department, lf.money(e.Salary))
+	if !e.Created.IsZero() {
+		info += " (since " + e.Created.Format(lf.date) + ")"
+	}
+	return info
+}
+
+// Two-decimal amount with thousands grouping and the currency symbol
+func (lf localeFormat) money(amount float64) string {
+	digits := strconv.FormatFloat(math.Abs(amount), 'f', 2, 64)
+	whole, frac, _ := strings.Cut(digits, ".")
+
+	var b strings.Builder
+	if amount < 0 && strings.Trim(digits, "0.") != "" {
+		b.WriteByte('-')
+	}
+	b.WriteString(lf.currencyPrefix)
+	for i, d := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteString(lf.group)
+		}
+		b.WriteRune(d)
+	}
+	b.WriteString(lf.decimal + frac + lf.currencySuffix)
+	return b.String()
+}
+
+// Splits pool proportionally to salary. Shares are whole cents: scaled
+// by 100 and rounded they add up exactly to the pool rounded to cents,
+// and DistributeBonusCents returns those integer cents directly.
+func DistributeBonus(employees []Employee, pool float64) (map[UserID]float64, error) {
+	cents, err := DistributeBonusCents(employees, pool)
+	if err != nil {
+		return nil, err
+	}
+	shares := make(map[UserID]float64, len(cents))
+	for id, c := range cents {
+		shares[id] = float64(c) / 100
+	}
+	return shares, nil
+}
+
+// Split of the pool in cents: every share is its exact proportional
+// amount rounded half-up to the cent, computed with rationals so float
+// salaries can't skew it, and the whole rounding remainder (positive or
+// negative) goes to the highest earner, first listed on ties. The shares
+// sum to round(pool*100); a pool too small to absorb the remainder
+// without a negative share is an error.
+func DistributeBonusCents(employees []Employee, pool float64) (map[UserID]int64, error) {
+	if !(pool > 0) || math.IsInf(pool, 1) {
+		return nil, fmt.Errorf("bonus pool %v must be positive and finite", pool)
+	}
+	if len(employees) == 0 {
+		return nil, errors.New("no employees to distribute the bonus to")
+	}
+
+	total := new(big.Rat)
+	seen := make(map[UserID]bool, len(employees))
+	for _, e := range employees {
+		if e.Salary < 0 || math.IsNaN(e.Salary) || math.IsInf(e.Salary, 0) {
+			return nil, fmt.Errorf("employee %d: invalid salary %v", e.ID, e.Salary)
+		}
+		if seen[e.ID] {
+			return nil, fmt.Errorf("employee %d listed twice", e.ID)
+		}
+		seen[e.ID] = true
+		total.Add(total, new(big.Rat).SetFloat64(e.Salary))
+	}
+	if total.Sign() == 0 {
+		return nil, errors.New("total salary is zero")
+	}
+
+	poolCents := int64(math.Round(pool * 100))
+	cents := make([]int64, len(employees))
+	remainder := poolCents
+	top := 0
+	for i, e := range employees {
+		exact := new(big.Rat).SetFloat64(e.Salary)
+		exact.Mul(exact, big.NewRat(poolCents, 1)).Quo(exact, total)
+		// floor(exact + 1/2) = (2*num + den) / (2*den)
+		num := new(big.Int).Lsh(exact.Num(), 1)
+		num.Add(num, exact.Denom())
+		cents[i] = num.Quo(num, new(big.Int).Lsh(exact.Denom(), 1)).Int64()
+		remainder -= cents[i]
+		if e.Salary > employees[top].Salary {
+			top = i
+		}
+	}
+
+	cents[top] += remainder
+	if cents[top] < 0 {
+		return nil, fmt.Errorf("bonus pool %v is too small to round to cents across %d employees", pool, len(employees))
+	}
+
+	shares := make(map[UserID]int64, len(employees))
+	for i, e := range employees {
+		shares[e.ID] = cents[i]
+	}
+	return shares, nil
+}
+
+// Roles allowed to see salaries
+var salaryRoles = Table[string, bool]{"hr": true, "manager": true}
+
+// JSON view for a role; the salary field is left out unless the role is
+// privileged, so an unknown role fails closed
+func (e Employee) MarshalFor(role string) ([]byte, error) {
+	if salaryRoles[role] {
+		return json.Marshal(e)
+	}
+	return json.Marshal(struct {
+		Person
+		Department string `json:"department"`
+	}{e.Person, e.Department})
+}
+
+// Named map type with methods
+type Roster map[string][]Employee
+
+// Groups employees by department, each group sorted by name; an empty
+// department is filed under "(unassigned)"
+func BuildRoster(employees []Employee) Roster {
+	roster := make(Roster)
+	for _, e := range employees {
+		dept := e.Department
+		if dept == "" {
+			dept = "(unassigned)"
+		}
+		roster[dept] = append(roster[dept], e)
+	}
+	for _, group := range roster {
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].Name < group[j].Name
+		})
+	}
+	return roster
+}
+
+func (r Roster) HeadCount() map[string]int {
+	counts := make(map[string]int, len(r))
+	for dept, group := range r {
+		counts[dept] = len(group)
+	}
+	return counts
+}
+
+// Function type used as an audit hook; at is when the field changed, not
+// when the entry reached the sink
+type AuditSink func(id UserID, at time.Time, field string, old, new interface{})
+
+// Side-effect hook run after a status actually changes
+type StatusObserver func(id UserID, from, to Status)
+
+// Entries a slow sink may fall behind by before setters start waiting
+const auditBuffer = 64
+
+type auditEntry struct {
+	id       UserID
+	at       time.Time
+	field    string
+	old, new interface{}
+}
+
+// Delivery settings for an AuditedPerson. The zero value stamps changes
+// with the system clock and never loses one: a setter waits for as long
+// as the sink needs to make room.
+type AuditOptions struct {
+	// Source of the mutation times passed to the sink; nil means the
+	// system clock
+	Clock Clock
+	// Longest a setter waits on a full queue before the change is
+	// dropped, logged and counted; zero waits indefinitely
+	MaxWait time.Duration
+}
+
+// Wrapper reporting every field change to an audit sink
+type AuditedPerson struct {
+	mu        sync.Mutex
+	person    Person
+	sink      AuditSink
+	observers []StatusObserver
+	clock     Clock
+	maxWait   time.Duration
+
+	// Delivery queue drained by a single goroutine, so sink calls keep
+	// mutation order and run outside the person's lock
+	sendMu  sync.RWMutex
+	closed  bool
+	entries chan auditEntry
+	drained chan struct{}
+	dropped atomic.Int64
+}
+
+// Constructor taking an optional (nil) sink and the default options;
+// with a sink, Close must be called to flush pending entries and stop the
+// delivery goroutine
+func NewAuditedPerson(p Person, sink AuditSink) *AuditedPerson {
+	return NewAuditedPersonWithOptions(p, sink, AuditOptions{})
+}
+
+// Like NewAuditedPerson, with an explicit clock and overflow policy
+func NewAuditedPersonWithOptions(p Person, sink AuditSink, opts AuditOptions) *AuditedPerson {
+	clock := opts.Clock
+	if clock == nil {
+		clock = systemClock
+	}
+	a := &AuditedPerson{person: p, sink: sink, clock: clock, maxWait: opts.MaxWait}
+	if sink != nil {
+		a.entries = make(chan auditEntry, auditBuffer)
+		a.drained = make(chan struct{})
+		go a.drain()
+	}
+	return a
+}
+
+// Delivers queued entries until Close; a panicking sink is logged and
+// skipped so later entries still arrive
+func (a *AuditedPerson) drain() {
+	defer close(a.drained)
+	for e := range a.entries {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("audit sink panicked on %s: %v", e.field, r)
+				}
+			}()
+			a.sink(e.id, e.at, e.field, e.old, e.new)
+		}()
+	}
+}
+
+// Waits for queued entries to reach the sink and stops delivery; later
+// changes are counted as dropped. Safe to call more than once.
+func (a *AuditedPerson) Close() {
+	if a.entries == nil {
+		return
+	}
+	a.sendMu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.entries)
+	}
+	a.sendMu.Unlock()
+	<-a.drained
+}
+
+// Entries discarded because MaxWait ran out or the person was closed
+func (a *AuditedPerson) Dropped() int64 {
+	return a.dropped.Load()
+}
+
+// Registers an observer; all registered observers fire, in order
+func (a *AuditedPerson) OnStatusChange(obs StatusObserver) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.observers = append(a.observers, obs)
+}
+
+// Snapshot of the wrapped person
+func (a *AuditedPerson) Person() Person {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.person
+}
+
+// Audited setter
+func (a *AuditedPerson) SetEmail(email string) error {
+	a.mu.Lock()
+	var old interface{}
+	if a.person.Email != nil {
+		old = *a.person.Email
+	}
+	if err := a.person.SetEmail(email); err != nil {
+		a.mu.Unlock()
+		return err
+	}
+	id := a.person.ID
+	a.mu.Unlock()
+
+	if old != email {
+		a.record(id, "email", old, email)
+	}
+	return nil
+}
+
+// Audited append, ignoring duplicate tags
+func (a *AuditedPerson) AddTag(tag string) {
+	a.mu.Lock()
+	for _, t := range a.person.Tags {
+		if t == tag {
+			a.mu.Unlock()
+			return
+		}
+	}
+	old := append([]string(nil), a.person.Tags...)
+	a.person.Tags = append(a.person.Tags, tag)
+	tags := append([]string(nil), a.person.Tags...)
+	id := a.person.ID
+	a.mu.Unlock()
+
+	a.record(id, "tags", old, tags)
+}
+
+// Audited status transition
+func (a *AuditedPerson) TransitionTo(to Status) error {
+	if !to.Valid() {
+		return fmt.Errorf("invalid status %q", to)
+	}
+
+	a.mu.Lock()
+	from := a.person.Status
+	a.person.Status = to
+	id := a.person.ID
+	observers := slices.Clone(a.observers)
+	a.mu.Unlock()
+
+	if from != to {
+		a.record(id, "status", from, to)
+		for _, obs := range observers {
+			notifyStatus(obs, id, from, to)
+		}
+	}
+	return nil
+}
+
+// Like a sink, a panicking observer is logged and skipped
+func notifyStatus(obs StatusObserver, id UserID, from, to Status) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("status observer panicked on %s -> %s: %v", from, to, r)
+		}
+	}()
+	obs(id, from, to)
+}
+
+// Hands a change, stamped now, to the delivery goroutine. When the sink
+// is auditBuffer entries behind, the caller waits for room, up to MaxWait
+// if one is set. Sinks run outside the person's lock, so they may read it
+// back.
+func (a *AuditedPerson) record(id UserID, field string, old, new interface{}) {
+	if a.entries == nil {
+		return
+	}
+	e := auditEntry{id: id, at: a.clock.Now(), field: field, old: old, new: new}
+	a.sendMu.RLock()
+	defer a.sendMu.RUnlock()
+	if a.closed {
+		a.drop(e, "audited person closed")
+		return
+	}
+	select {
+	case a.entries <- e:
+		return
+	default:
+	}
+	if a.maxWait <= 0 {
+		a.entries <- e
+		return
+	}
+	select {
+	case a.entries <- e:
+	case <-a.clock.After(a.maxWait):
+		a.drop(e, fmt.Sprintf("sink still %d entries behind after %v", auditBuffer, a.maxWait))
+	}
+}
+
+// Every lost change is logged as well as counted
+func (a *AuditedPerson) drop(e auditEntry, reason string) {
+	a.dropped.Add(1)
+	log.Printf("audit: dropped %s change of user %d at %s: %s", e.field, e.id, e.at.Format(time.RFC3339Nano), reason)
+}
+
+// One recorded field change
+type Change struct {
+	At    time.Time   `json:"at"`
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// Accumulated changes; the zero value is ready to use. Record stamps
+// entries with Clock (the system clock when nil), while entries arriving
+// through Sink keep the time the field changed.
+type AuditTrail struct {
+	Clock Clock
+
+	mu      sync.Mutex
+	changes []Change
+}
+
+func (t *AuditTrail) Record(field string, old, new interface{}) {
+	clock := t.Clock
+	if clock == nil {
+		clock = systemClock
+	}
+	t.record(clock.Now(), field, old, new)
+}
+
+func (t *AuditTrail) record(at time.Time, field string, old, new interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.changes = append(t.changes, Change{At: at, Field: field, Old: old, New: new})
+}
+
+// Adapter so a trail can back an AuditedPerson
+func (t *AuditTrail) Sink() AuditSink {
+	return func(_ UserID, at time.Time, field string, old, new interface{}) {
+		t.record(at, field, old, new)
+	}
+}
+
+// Chronological copy; entries with equal times keep recording order
+func (t *AuditTrail) Changes() []Change {
+	t.mu.Lock()
+	changes := slices.Clone(t.changes)
+	t.mu.Unlock()
+	slices.SortStableFunc(changes, func(a, b Change) int {
+		return a.At.Compare(b.At)
+	})
+	return changes
+}
+
+// Chronological JSON array (never null). Pointer receiver: marshal
+// &trail, not trail.
+func (t *AuditTrail) MarshalJSON() ([]byte, error) {
+	changes := t.Changes()
+	if changes == nil {
+		changes = []Change{}
+	}
+	return json.Marshal(changes)
+}
+
+// Generic function (Go 1.18+). Returns the first maximal element, or the
+// zero value for empty input. NaN policy: elements unequal to themselves
+// (float NaNs) are skipped, so an all-NaN slice also yields the zero value.
+//
+// Deprecated: For ordered types use MinMax, which also reports whether the
+// input had a maximum at all.
+func FindMax[T comparable](items []T, less func(T, T) bool) T {
+	return findBest(items, func(best, item T) bool { return less(best, item) })
+}
+
+// Mirror of FindMax with the same empty-input and NaN policy
+func FindMin[T comparable](items []T, less func(T, T) bool) T {
+	return findBest(items, func(best, item T) bool { return less(item, best) })
+}
+
+func findBest[T comparable](items []T, better func(best, item T) bool) T {
+	var best T
+	found := false
+	for _, item := range items {
+		if item != item { // NaN
+			continue
+		}
+		if !found || better(best, item) {
+			best, found = item, true
+		}
+	}
+	return best
+}
+
+// Generic variadic function: round-robin interleaving of slices
+func Interleave[T any](slices ...[]T) []T {
+	total, longest := 0, 0
+	for _, s := range slices {
+		total += len(s)
+		longest = max(longest, len(s))
+	}
+
+	result := make([]T, 0, total)
+	for i := 0; i < longest; i++ {
+		for _, s := range slices {
+			if i < len(s) {
+				result = append(result, s[i])
+			}
+		}
+	}
+	return result
+}
+
+// Generic pass-through for observing pipeline values. The input slice is
+// returned as-is (same backing array); nothing is copied.
+func Tap[T any](items []T, observe func(T)) []T {
+	for _, item := range items {
+		observe(item)
+	}
+	return items
+}
+
+// Bounds-checked insertion; the result never aliases s
+func Insert[T any](s []T, index int, vals ...T) ([]T, error) {
+	if index < 0 || index > len(s) {
+		return nil, fmt.Errorf("insert index %d out of range [0, %d]", index, len(s))
+	}
+	result := make([]T, 0, len(s)+len(vals))
+	result = append(result, s[:index]...)
+	result = append(result, vals...)
+	return append(result, s[index:]...), nil
+}
+
+// Bounds-checked removal; the result never aliases s
+func RemoveAt[T any](s []T, index int) ([]T, error) {
+	if index < 0 || index >= len(s) {
+		return nil, fmt.Errorf("remove index %d out of range [0, %d)", index, len(s))
+	}
+	result := make([]T, 0, len(s)-1)
+	result = append(result, s[:index]...)
+	return append(result, s[index+1:]...), nil
+}
+
+// Generic struct holding one memoized result
+type memoEntry[R any] struct {
+	once  sync.Once
+	value R
+}
+
+// Memoization of a pure function: fn runs once per distinct argument, even
+// under concurrent calls. Entries are never evicted, so the cache grows
+// with the number of distinct arguments.
+func Memoize[A comparable, R any](fn func(A) R) func(A) R {
+	var mu sync.Mutex
+	cache := make(map[A]*memoEntry[R])
+	return func(arg A) R {
+		mu.Lock()
+		e, ok := cache[arg]
+		if !ok {
+			e = &memoEntry[R]{}
+			cache[arg] = e
+		}
+		mu.Unlock()
+
+		e.once.Do(func() { e.value = fn(arg) })
+		return e.value
+	}
+}
+
+// Generic functions constrained by cmp.Ordered
+func Clamp[T cmp.Ordered](v, lo, hi T) T {
+	return max(lo, min(v, hi))
+}
+
+func InRange[T cmp.Ordered](v, lo, hi T) bool {
+	return v >= lo && v <= hi
+}
+
+// Both extremes in one pass; ok is false for empty input. Same NaN policy
+// as FindMax: NaNs are skipped, so an all-NaN slice also reports !ok.
+func MinMax[T cmp.Ordered](items []T) (min, max T, ok bool) {
+	for _, item := range items {
+		switch {
+		case item != item:
+			continue
+		case !ok:
+			min, max, ok = item, item, true
+		case item < min:
+			min = item
+		case item > max:
+			max = item
+		}
+	}
+	return min, max, ok
+}
+
+// Binary-search insertion into a slice already sorted by less; equal
+// elements keep insertion order. Like append, it may reuse s's array.
+func SortedInsert[T any](s []T, v T, less func(a, b T) bool) []T {
+	i := sort.Search(len(s), func(i int) bool { return less(v, s[i]) })
+	var zero T
+	s = append(s, zero)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
+
+// Ordered fan-in: submit stores each value at its index, results blocks
+// until all n indexes were submitted. Submitting an index twice or out of
+// range panics, as it would otherwise hang results forever.
+func OrderedResults[T any](n int) (submit func(index int, v T), results func() []T) {
+	var mu sync.Mutex
+	values := make([]T, n)
+	seen := make([]bool, n)
+	remaining := n
+	done := make(chan struct{})
+	if n == 0 {
+		close(done)
+	}
+
+	submit = func(index int, v T) {
+		mu.Lock()
+		defer mu.Unlock()
+		if index < 0 || index >= n {
+			panic(fmt.Sprintf("OrderedResults: index %d out of range [0, %d)", index, n))
+		}
+		if seen[index] {
+			panic(fmt.Sprintf("OrderedResults: index %d submitted twice", index))
+		}
+		seen[index] = true
+		values[index] = v
+		if remaining--; remaining == 0 {
+			close(done)
+		}
+	}
+	results = func() []T {
+		<-done
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]T(nil), values...)
+	}
+	return submit, results
+}
+
+// Retries while op fails or its result is rejected by accept; attempts
+// below 1 fall back to MaxRetries. On exhaustion the last result is
+// returned with the last error, or with a rejection error if op succeeded.
+func RetryUntil[T any](attempts int, op func() (T, error), accept func(T) bool) (T, error) {
+	if attempts < 1 {
+		attempts = MaxRetries
+	}
+	var result T
+	var err error
+	for i := 0; i < attempts; i++ {
+		result, err = op()
+		if err == nil && accept(result) {
+			return result, nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("result not accepted after %d attempts", attempts)
+	}
+	return result, err
+}
+
+// Longest shared leading run of two slices (a subslice of a)
+func CommonPrefix[T comparable](a, b []T) []T {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return a[:n]
+}
+
+func HasPrefix[T comparable](s, prefix []T) bool {
+	return len(prefix) <= len(s) && len(CommonPrefix(s, prefix)) == len(prefix)
+}
+
+// Counting semaphore backed by a buffered channel
+type Semaphore struct {
+	slots chan struct{}
+}
+
+func NewSemaphore(n int) *Semaphore {
+	if n < 1 {
+		panic(fmt.Sprintf("NewSemaphore: size %d must be at least 1", n))
+	}
+	return &Semaphore{slots: make(chan struct{}, n)}
+}
+
+// Blocks until a slot is free or ctx is done
+func (s *Semaphore) Acquire(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Semaphore) TryAcquire() bool {
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Semaphore) Release() {
+	select {
+	case <-s.slots:
+	default:
+		panic("Semaphore: Release without Acquire")
+	}
+}
+
+// Leading-edge throttle: the first call runs fn immediately, later calls
+// are dropped until interval has passed since the last run
+func Throttle(interval time.Duration, fn func()) func() {
+	return throttle(systemClock, interval, fn)
+}
+
+// Throttle reading the time from clock
+func throttle(clock Clock, interval time.Duration, fn func()) func() {
+	var mu sync.Mutex
+	var last time.Time
+	ran := false
+	return func() {
+		mu.Lock()
+		now := clock.Now()
+		if ran && now.Sub(last) < interval {
+			mu.Unlock()
+			return
+		}
+		last, ran = now, true
+		mu.Unlock()
+		fn()
+	}
+}
+
+// Re-keys a map; two keys mapping to the same new key is an error
+func MapKeys[K1, K2 comparable, V any](m map[K1]V, f func(K1) K2) (map[K2]V, error) {
+	out := make(map[K2]V, len(m))
+	from := make(map[K2]K1, len(m))
+	for k, v := range m {
+		nk := f(k)
+		if prev, ok := from[nk]; ok {
+			return nil, fmt.Errorf("keys %v and %v both map to %v", prev, k, nk)
+		}
+		from[nk] = k
+		out[nk] = v
+	}
+	return out, nil
+}
+
+// Type-safe wrapper around sync.Map
+type SyncMap[K comparable, V any] struct {
+	m sync.Map
+}
+
+// Comma-ok assertions below keep a stored nil interface value from panicking
+func (s *SyncMap[K, V]) Load(key K) (value V, ok bool) {
+	v, ok := s.m.Load(key)
+	if !ok {
+		return value, false
+	}
+	value, _ = v.(V)
+	return value, true
+}
+
+func (s *SyncMap[K, V]) Store(key K, value V) {
+	s.m.Store(key, value)
+}
+
+func (s *SyncMap[K, V]) Delete(key K) {
+	s.m.Delete(key)
+}
+
+// Returns the existing value if present, otherwise stores and returns value
+func (s *SyncMap[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
+	v, loaded := s.m.LoadOrStore(key, value)
+	actual, _ = v.(V)
+	return actual, loaded
+}
+
+// Stops early when fn returns false, like sync.Map.Range
+func (s *SyncMap[K, V]) Range(fn func(key K, value V) bool) {
+	s.m.Range(func(k, v any) bool {
+		value, _ := v.(V)
+		return fn(k.(K), value)
+	})
+}
+
+// Counts items per bucket key
+func Histogram[T any, K comparable](items []T, bucket func(T) K) Table[K, int] {
+	counts := make(Table[K, int])
+	for _, item := range items {
+		counts[bucket(item)]++
+	}
+	return counts
+}
+
+// Splits items into consecutive groups, starting a new group wherever
+// isBoundary(prev, cur) reports true. Groups share items' backing array.
+func SplitWhen[T any](items []T, isBoundary func(prev, cur T) bool) [][]T {
+	if len(items) == 0 {
+		return nil
+	}
+	var groups [][]T
+	start := 0
+	for i := 1; i < len(items); i++ {
+		if isBoundary(items[i-1], items[i]) {
+			groups = append(groups, items[start:i:i])
+			start = i
+		}
+	}
+	return append(groups, items[start:])
+}
+
+// Index/value pairs, like Python's enumerate
+func Enumerate[T any](items []T) []struct {
+	Index int
+	Value T
+} {
+	out := make([]struct {
+		Index int
+		Value T
+	}, len(items))
+	for i, v := range items {
+		out[i].Index, out[i].Value = i, v
+	}
+	return out
+}
+
+// Emits values cyclically until ctx is done, then closes; with no values
+// the channel is closed immediately
+func Repeat[T any](ctx context.Context, values ...T) <-chan T {
+	ch := make(chan T)
+	values = slices.Clone(values)
+	go func() {
+		defer close(ch)
+		if len(values) == 0 {
+			return
+		}
+		for i := 0; ; i = (i + 1) % len(values) {
+			select {
+			case ch <- values[i]:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// In-place Fisher-Yates shuffle; a nil r uses the package-level source,
+// which is safe for concurrent use but not reproducible
+func Shuffle[T any](items []T, r *rand.Rand) {
+	intn := rand.Intn //nolint:gosec // shuffling, not cryptography
+	if r != nil {
+		intn = r.Intn
+	}
+	for i := len(items) - 1; i > 0; i-- {
+		j := intn(i + 1)
+		items[i], items[j] = items[j], items[i]
+	}
+}
+
+func ShuffledCopy[T any](items []T, r *rand.Rand) []T {
+	out := slices.Clone(items)
+	Shuffle(out, r)
+	return out
+}
+
+// Copy without zero-value elements, order preserved. Unlike
+// slices.Compact this drops every zero value, not consecutive duplicates.
+func Compact[T comparable](items []T) []T {
+	var zero T
+	return CompactFunc(items, func(v T) bool { return v == zero })
+}
+
+// Compact for non-comparable types, with a caller-supplied zero test.
+// The result is sized for the whole input up front, trading unused
+// capacity for a single allocation.
+func CompactFunc[T any](items []T, isZero func(T) bool) []T {
+	out := make([]T, 0, len(items))
+	for _, v := range items {
+		if !isZero(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// Groups of items sharing a key, keeping only keys seen more than once;
+// each group is in input order
+func DuplicateGroups[T any, K comparable](items []T, key func(T) K) Table[K, []T] {
+	groups := make(Table[K, []T])
+	for _, item := range items {
+		k := key(item)
+		groups[k] = append(groups[k], item)
+	}
+	maps.DeleteFunc(groups, func(_ K, group []T) bool {
+		return len(group) < 2
+	})
+	return groups
+}
+
+// Fan-in of two sources until both are drained or ctx is done
+func Merge[T any](ctx context.Context, a, b <-chan T) <-chan T {
+	out := make(chan T)
+	go mergeInto(ctx, (chan<- T)(out), a, b)
+	return out
+}
+
+// A drained source is set to nil: receiving from a nil channel blocks
+// forever, so select stops considering it
+func mergeInto[T any](ctx context.Context, out chan<- T, a, b <-chan T) {
+	defer close(out)
+	for a != nil || b != nil {
+		var v T
+		var ok bool
+		select {
+		case v, ok = <-a:
+			if !ok {
+				a = nil
+				continue
+			}
+		case v, ok = <-b:
+			if !ok {
+				b = nil
+				continue
+			}
+		case <-ctx.Done():
+			return
+		}
+
+		select {
+		case out <- v:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Non-blocking channel operations via select with default
+func TrySend[T any](ch chan<- T, v T) bool {
+	select {
+	case ch <- v:
+		return true
+	default:
+		return false
+	}
+}
+
+func TryReceive[T any](ch <-chan T) (T, bool) {
+	select {
+	case v, ok := <-ch:
+		return v, ok
+	default:
+		var zero T
+		return zero, false
+	}
+}
+
+// Lookup table by key; on duplicate keys the last item wins
+func Index[T any, K comparable](items []T, key func(T) K) Table[K, T] {
+	index := make(Table[K, T], len(items))
+	for _, item := range items {
+		index[key(item)] = item
+	}
+	return index
+}
+
+// Like Index, but the first item per key wins
+func IndexFirst[T any, K comparable](items []T, key func(T) K) Table[K, T] {
+	index := make(Table[K, T], len(items))
+	for _, item := range items {
+		k := key(item)
+		if _, ok := index[k]; !ok {
+			index[k] = item
+		}
+	}
+	return index
+}
+
+// Online mean/variance accumulator (Welford's algorithm)
+type RunningStats struct {
+	n    int
+	mean float64
+	m2   float64
+}
+
+func (s *RunningStats) Add(x float64) {
+	s.n++
+	delta := x - s.mean
+	s.mean += delta / float64(s.n)
+	s.m2 += delta * (x - s.mean)
+}
+
+func (s *RunningStats) Count() int {
+	return s.n
+}
+
+func (s *RunningStats) Mean() float64 {
+	return s.mean
+}
+
+// Population variance; zero until at least one value was added
+func (s *RunningStats) Variance() float64 {
+	if s.n == 0 {
+		return 0
+	}
+	return s.m2 / float64(s.n)
+}
+
+// Constraint interface with a union type set; ~ admits named types such
+// as UserID whose underlying type is listed
+type Number interface {
+	~int | ~int32 | ~int64 | ~float32 | ~float64
+}
+
+// Constraint matching every string-based type (Status, for one)
+type Stringish interface {
+	~string
+}
+
+func SumOf[T Number](items ...T) T {
+	var total T
+	for _, v := range items {
+		total += v
+	}
+	return total
+}
+
+func JoinAs[S Stringish](items []S, sep string) string {
+	parts := make([]string, len(items))
+	for i, s := range items {
+		parts[i] = string(s)
+	}
+	return strings.Join(parts, sep)
+}
+
+// Generic struct type; methods use the parameterized receiver Stack[T]
+type Stack[T any] struct {
+	items []T
+}
+
+func (s *Stack[T]) Push(v T) {
+	s.items = append(s.items, v)
+}
+
+func (s *Stack[T]) Pop() (T, bool) {
+	var zero T
+	if len(s.items) == 0 {
+		return zero, false
+	}
+	v := s.items[len(s.items)-1]
+	s.items = s.items[:len(s.items)-1]
+	return v, true
+}
+
+func (s *Stack[T]) Len() int {
+	return len(s.items)
+}
+
+// comparable and any side by side
+type Pair[K comparable, V any] struct {
+	Key   K
+	Value V
+}
+
+// Nested type parameters: M is constrained by a map over K and V
+func SortedPairs[M ~map[K]V, K cmp.Ordered, V any](m M) []Pair[K, V] {
+	pairs := make([]Pair[K, V], 0, len(m))
+	for _, k := range slices.Sorted(maps.Keys(m)) {
+		pairs = append(pairs, Pair[K, V]{Key: k, Value: m[k]})
+	}
+	return pairs
+}
+
+// Labeled loops, fallthrough and goto: the first adult carrying tag
+// (case-insensitive). Inactive people are never matched; pending ones
+// only once their age is known.
+func FindFirstAdultWithTag(people []Person, tag string) (*Person, bool) {
+	var found *Person
+	if tag = strings.TrimSpace(tag); tag == "" {
+		goto done
+	}
+
+people:
+	for i := range people {
+		p := &people[i]
+		switch p.Status {
+		case StatusPending:
+			if p.Age == 0 {
+				continue people
+			}
+			fallthrough
+		case StatusActive:
+			if !p.IsAdult() {
+				continue people
+			}
+		default:
+			continue people
+		}
+
+		for _, t := range p.Tags {
+			if strings.EqualFold(strings.TrimSpace(t), tag) {
+				found = p
+				break people
+			}
+		}
+	}
+
+done:
+	return found, found != nil
+}
+
+// String, rune and number literal forms
+const (
+	rawBanner = `zero-trust
+  "double" and 'single' quotes, \n and \t stay literal here
+`
+	rawWithTick = `before the tick ` + "`" + ` after the tick`
+	escaped     = "tab:\t newline:\n hex:\xFF accent:\u00e9 rocket:\U0001F680 quote:\" backslash:\\"
+
+	quoteRune     = '\''
+	backslashRune = '\\'
+	hexRune       = '\x41'
+	octalRune     = '\101'
+	accentRune    = '\u00e9'
+	rocketRune    = '\U0001F680'
+	bellRune      = '\a'
+
+	fileMode    = 0o755
+	legacyMode  = 0644
+	flagMask    = 0b1010_0101
+	accentColor = 0xFF_88_00
+	million     = 1_000_000
+	hexFloat    = 0x1.fp-2 // 0.484375
+	avogadro    = 6.022_140_76e23
+	huge        = 1 << 100   // untyped: too big for any integer type...
+	hugeScaled  = huge >> 98 // ...but fine once scaled back down
+	pythagorean = 3 + 4i
+)
+
+// CRC-32 over every literal above, so a typo in any of them shows up.
+// Kept out of line so it is easy to spot in profiles.
+//
+//go:noinline
+func literalChecksum() uint32 {
+	var buf []byte
+	buf = append(buf, rawBanner+rawWithTick+escaped...)
+	buf = append(buf, string([]rune{quoteRune, backslashRune, hexRune, octalRune, accentRune, rocketRune, bellRune})...)
+	buf = binary.BigEndian.AppendUint64(buf, fileMode|legacyMode|flagMask|accentColor|million|hugeScaled)
+	buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(hexFloat*avogadro))
+	return crc32.ChecksumIEEE(buf)
+}
+
+// |z| for z = (3+4i)·i, which is still 5
+func complexMagnitude() float64 {
+	var z complex128 = pythagorean
+	z *= 1i
+	return math.Hypot(real(z), imag(z))
+}
+
+// Multi-key struct tags; Owner's tag is legal but looks malformed: a
+// leading "-," names the JSON key "-" instead of skipping the field
+type ConfigRecord struct {
+	Name     string `json:"name,omitempty" yaml:"name" validate:"required,max=64" db:"name,primarykey"`
+	Region   string `json:"region" yaml:"region,omitempty" db:"region" doc:"data center, e.g. \"eu-west\""`
+	Replicas int    `json:"replicas,string" validate:"min=1,max=9" db:"replicas"`
+	Owner    string `json:"-," yaml:",flow" db:"owner"`
+	Token    string `json:"-" yaml:"-" db:"token" redact:""`
+	Scratch  string `db:"-"`
+}
+
+// Column metadata read from db, validate, doc and redact tags
+type ColumnSpec struct {
+	Field      string
+	Column     string
+	PrimaryKey bool
+	Required   bool
+	Redacted   bool
+	Doc        string
+}
+
+// Reflect over a struct's tags; fields without a db tag, or tagged
+// db:"-", are skipped
+func ColumnSpecs(v any) ([]ColumnSpec, error) {
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("column specs: %v is not a struct", t)
+	}
+
+	var specs []ColumnSpec
+	for i := range t.NumField() {
+		f := t.Field(i)
+		db, ok := f.Tag.Lookup("db")
+		if !ok || db == "-" {
+			continue
+		}
+		column, opts, _ := strings.Cut(db, ",")
+		spec := ColumnSpec{
+			Field:      f.Name,
+			Column:     column,
+			PrimaryKey: slices.Contains(strings.Split(opts, ","), "primarykey"),
+			Required:   slices.Contains(strings.Split(f.Tag.Get("validate"), ","), "required"),
+			Doc:        f.Tag.Get("doc"),
+		}
+		// Presence is what matters for redact, so Get would not do
+		_, spec.Redacted = f.Tag.Lookup("redact")
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// Function with multiple return values
+func divide(a, b float64) (float64, error) {
+	if b == 0 {
+		return 0, ErrDivisionByZero
+	}
+	q := a / b
+	if math.IsNaN(q) { // NaN operand, or Inf/Inf
+		return 0, fmt.Errorf("%v / %v: %w", a, b, ErrIndeterminate)
+	}
+	return q, nil
+}
+
+// Function with named return values
+func swap(x, y string) (first, second string) {
+	first = y
+	second = x
+	return // naked return
+}
+
+// Variadic function (overflow wraps around, as with any int addition)
+func sum(numbers ...int) int {
+	total := 0
+	for _, num := range numbers {
+		total += num
+	}
+	return total
+}
+
+// Source of time, swappable for a fake in deterministic runs
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+// Clock backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+var systemClock Clock = realClock{}
+
+// Manually driven clock; Sleep advances virtual time instead of blocking
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Sleep(d time.Duration) {
+	c.Advance(d)
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.timers = append(c.timers, fakeTimer{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance moves virtual time forward and fires every timer that is due
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.ch <- c.now
+	}
+	c.timers = pending
+}
+
+// Set when callers opt out of the fetch default timeout; the zero value
+// keeps enforcement on
+var defaultTimeoutOff atomic.Bool
+
+// Toggles whether fetches without a deadline get DefaultTimeout applied
+func SetEnforceDefaultTimeout(on bool) {
+	defaultTimeoutOff.Store(!on)
+}
+
+// Bounds ctx by DefaultTimeout unless it already has a deadline
+func withDefaultTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || defaultTimeoutOff.Load() {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, DefaultTimeout)
 }
 
 // Function with context
-func fetchUserData(ctx context.Context, userID UserID) (*Person, error) {
-	// Simulate API call with timeout
+func fetchUserData(ctx context.Context, clock Clock, userID UserID) (*Person, error) {
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+
+	// Simulate API latency
+	done := make(chan struct{})
+	go func() {
+		clock.Sleep(100 * time.Millisecond)
+		close(done)
+	}()
+
 	select {
-	case <-time.After(100 * time.Millisecond):
+	case <-done:
+		now := clock.Now()
 		return &Person{
 			ID:      userID,
 			Name:    "John Doe",
 			Age:     30,
 			Status:  StatusActive,
-			Created: time.Now(),
+			Created: now,
 			Tags:    []string{"developer", "golang"},
 			Metadata: map[string]interface{}{
-				"last_login": time.Now().Unix(),
+				"last_login": now.Unix(),
 				"ip_address": "192.168.1.1",
 			},
 		}, nil
@@ -160,43 +3118,108 @@ func fetchUserData(ctx context.Context, userID UserID) (*Person, error) {
 	}
 }
 
+// Unexported context key type
+type requestIDKey struct{}
+
+// Context helpers for request correlation
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok
+}
+
+// Logging decorator around fetchUserData
+func LoggedFetch(ctx context.Context, id UserID) (*Person, error) {
+	start := time.Now()
+	attrs := []any{slog.Int64("user_id", int64(id))}
+	if requestID, ok := RequestIDFromContext(ctx); ok {
+		attrs = append(attrs, slog.String("request_id", requestID))
+	}
+	logger.InfoContext(ctx, "fetch started", attrs...)
+
+	p, err := fetchUserData(ctx, systemClock, id)
+	attrs = append(attrs, slog.Duration("duration", time.Since(start)))
+	if err != nil {
+		logger.ErrorContext(ctx, "fetch failed", append(attrs, slog.Any("error", err))...)
+		return nil, err
+	}
+	logger.InfoContext(ctx, "fetch finished", attrs...)
+	return p, nil
+}
+
+// Printer with injectable writer, safe for concurrent use
+type Printer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Constructor function
+func NewPrinter(w io.Writer) *Printer {
+	return &Printer{w: w}
+}
+
+// Variadic method forwarding to fmt
+func (p *Printer) Printf(format string, args ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintf(p.w, format, args...)
+}
+
+// Println counterpart
+func (p *Printer) Println(args ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintln(p.w, args...)
+}
+
+// Everything the demo prints to or waits on
+type demoEnv struct {
+	out     *Printer
+	clock   Clock
+	workers int
+}
+
 // Function with defer
-func processFile(filename string) error {
-	fmt.Printf("Processing file: %s\n", filename)
+func processFile(env demoEnv, filename string) error {
+	out := env.out
+	out.Printf("Processing file: %s\n", filename)
 
 	// Simulate file operations
 	defer func() {
-		fmt.Printf("Finished processing: %s\n", filename)
+		out.Printf("Finished processing: %s\n", filename)
 	}()
 
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Printf("Recovered from panic: %v\n", r)
+			out.Printf("Recovered from panic: %v\n", r)
 		}
 	}()
 
 	// Simulate some work
-	time.Sleep(10 * time.Millisecond)
+	env.clock.Sleep(10 * time.Millisecond)
 	return nil
 }
 
 // Goroutine worker function
-func worker(id int, jobs <-chan int, results chan<- int) {
+func worker(env demoEnv, id int, jobs <-chan int, results chan<- int) {
 	for job := range jobs {
-		fmt.Printf("Worker %d processing job %d\n", id, job)
-		time.Sleep(time.Millisecond)
+		env.out.Printf("Worker %d processing job %d\n", id, job)
+		env.clock.Sleep(time.Millisecond)
 		results <- job * 2
 	}
 }
 
 // Function demonstrating channels
-func demonstrateChannels() {
+func demonstrateChannels(env demoEnv) {
 	jobs := make(chan int, 100)
 	results := make(chan int, 100)
 
 	// Start workers
-	for w := 1; w <= 3; w++ {
-		go worker(w, jobs, results)
+	for w := 1; w <= env.workers; w++ {
+		go worker(env, w, jobs, results)
 	}
 
 	// Send jobs
@@ -211,35 +3234,741 @@ func demonstrateChannels() {
 	}
 }
 
+// Cancellable version of the job pipeline: doubles every job using
+// workers goroutines. On cancellation it returns the results finished so
+// far (in job order) with ctx.Err(). The feeder and all workers have
+// stopped before it returns, so nothing is left blocked.
+func ProcessJobsCtx(ctx context.Context, jobs []int, workers int) ([]int, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	type result struct{ index, value int }
+	indices := make(chan int)
+	results := make(chan result)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(indices)
+		for i := range jobs {
+			select {
+			case indices <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				select {
+				case results <- result{i, jobs[i] * 2}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	values := make([]int, len(jobs))
+	finished := make([]bool, len(jobs))
+	for r := range results {
+		values[r.index], finished[r.index] = r.value, true
+	}
+
+	var out []int
+	for i, ok := range finished {
+		if ok {
+			out = append(out, values[i])
+		}
+	}
+	return out, ctx.Err()
+}
+
 // Function with select statement
-func selectExample() {
+func selectExample(env demoEnv) {
+	out := env.out
 	ch1 := make(chan string)
 	ch2 := make(chan string)
 
+	// One producer keeps the send order fixed under a fake clock
 	go func() {
-		time.Sleep(100 * time.Millisecond)
+		env.clock.Sleep(100 * time.Millisecond)
 		ch1 <- "message from ch1"
-	}()
-
-	go func() {
-		time.Sleep(200 * time.Millisecond)
+		env.clock.Sleep(100 * time.Millisecond)
 		ch2 <- "message from ch2"
 	}()
 
 	for i := 0; i < 2; i++ {
 		select {
 		case msg1 := <-ch1:
-			fmt.Println("Received:", msg1)
+			out.Println("Received:", msg1)
 		case msg2 := <-ch2:
-			fmt.Println("Received:", msg2)
-		case <-time.After(300 * time.Millisecond):
-			fmt.Println("Timeout")
+			out.Println("Received:", msg2)
+		case <-env.clock.After(300 * time.Millisecond):
+			out.Println("Timeout")
+		}
+	}
+}
+
+// Push iterator over people keyed by ID, for range-over-func
+func PeopleByID(people []Person) iter.Seq2[UserID, Person] {
+	return func(yield func(UserID, Person) bool) {
+		for _, p := range people {
+			if !yield(p.ID, p) {
+				return
+			}
+		}
+	}
+}
+
+// Go 1.22+ loop forms and the min/max/clear builtins
+func rangeFuncExample(env demoEnv) {
+	out := env.out
+	people := []Person{
+		{ID: 10, Name: "Ada", Age: 36},
+		{ID: 11, Name: "Linus", Age: 17},
+		{ID: 12, Name: "Grace", Age: 45},
+	}
+
+	// Range over a function iterator, stopping early
+	for id, p := range PeopleByID(people) {
+		if !p.IsAdult() {
+			out.Printf("Stopping at minor #%d\n", id)
+			break
+		}
+		out.Printf("Adult #%d: %s\n", id, p.Name)
+	}
+
+	// Range over an integer; each iteration has its own i, so the
+	// goroutines can capture it directly
+	squares := make([]int, 4)
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			squares[i] = i * i
+		}()
+	}
+	wg.Wait()
+	out.Println("Squares:", squares)
+
+	// min and max builtins, then clear on a map and a slice
+	youngest := min(people[0].Age, people[1].Age, people[2].Age)
+	oldest := max(people[0].Age, people[1].Age, people[2].Age)
+	out.Printf("Age range: %d-%d\n", youngest, oldest)
+
+	byName := map[string]int{"Ada": 36, "Grace": 45}
+	clear(byName)
+	clear(squares)
+	out.Printf("After clear: %d names, squares %v\n", len(byName), squares)
+}
+
+// Named function type; plain func(Person) string values convert to it
+type Formatter func(Person) string
+
+// Struct with function-typed fields
+type GreetingHandlers struct {
+	Styles   map[string]Formatter
+	Fallback Formatter
+	OnMiss   func(style string)
+}
+
+// Looks up a style, reporting misses before falling back
+func (h GreetingHandlers) Format(style string, p Person) string {
+	if f, ok := h.Styles[style]; ok {
+		return f(p)
+	}
+	if h.OnMiss != nil {
+		h.OnMiss(style)
+	}
+	return h.Fallback(p)
+}
+
+// Higher-order function: wraps a formatter, returning a new one
+func shout(f func(Person) string) func(Person) string {
+	return func(p Person) string {
+		return strings.ToUpper(f(p)) + "!"
+	}
+}
+
+// Runs a bound method value handed over as a plain callback
+func announce(out *Printer, label string, greet func() string) {
+	out.Printf("%s: %s\n", label, greet())
+}
+
+// Method expressions, method values and function type conversions
+func methodValuesExample(env demoEnv) {
+	out := env.out
+
+	// Method expressions: Person.String takes the receiver as its first
+	// argument; (*Person).Greet needs a pointer
+	greetPtr := (*Person).Greet
+	styles := map[string]func(Person) string{
+		"plain": Person.String,
+		"greet": func(p Person) string { return greetPtr(&p) },
+		"loud":  shout(Person.String),
+	}
+
+	handlers := GreetingHandlers{
+		Styles:   make(map[string]Formatter, len(styles)),
+		Fallback: Formatter(Person.String),
+		OnMiss:   func(style string) { out.Printf("No %q style, using fallback\n", style) },
+	}
+	for name, f := range styles {
+		handlers.Styles[name] = Formatter(f) // func(Person) string -> Formatter
+	}
+
+	people := []Person{
+		{ID: 20, Name: "Ada", Age: 36, Status: StatusActive},
+		{ID: 21, Name: "Linus", Age: 17, Status: StatusPending},
+		{ID: 22, Name: "Grace", Age: 45, Status: StatusInactive},
+	}
+	styleFor := map[Status]string{
+		StatusActive:   "greet",
+		StatusPending:  "loud",
+		StatusInactive: "formal",
+	}
+	for _, p := range people {
+		out.Println(handlers.Format(styleFor[p.Status], p))
+	}
+
+	// Method value: the receiver is bound now, the call happens later
+	greet := people[0].Greet
+	announce(out, "Bound greeting", greet)
+
+	// And back again: a Formatter converts to its underlying func type
+	var plain func(Person) string = handlers.Fallback
+	out.Println("Converted back:", plain(people[1]))
+}
+
+// Per-status report rows, built entirely from anonymous types
+func statusSummary(people PersonList) []struct {
+	Name  string
+	Count int
+	Ages  string
+} {
+	// Map whose value type is an anonymous struct
+	byStatus := map[Status]struct {
+		Count    int
+		Youngest int
+		Oldest   int
+	}{}
+	for _, p := range people {
+		s, seen := byStatus[p.Status]
+		if !seen {
+			s.Youngest, s.Oldest = p.Age, p.Age
+		}
+		s.Count++
+		s.Youngest = min(s.Youngest, p.Age)
+		s.Oldest = max(s.Oldest, p.Age)
+		byStatus[p.Status] = s
+	}
+
+	var rows []struct {
+		Name  string
+		Count int
+		Ages  string
+	}
+	for _, status := range slices.Sorted(maps.Keys(byStatus)) {
+		s := byStatus[status]
+		rows = append(rows, struct {
+			Name  string
+			Count int
+			Ages  string
+		}{string(status), s.Count, fmt.Sprintf("%d-%d", s.Youngest, s.Oldest)})
+	}
+	return rows
+}
+
+// Parameter typed as an inline anonymous interface
+func greetAll(out *Printer, greeters ...interface{ Greet() string }) {
+	for _, g := range greeters {
+		out.Println(g.Greet())
+	}
+}
+
+// Anonymous structs and interfaces, and nested composite literals
+func anonymousTypesExample(env demoEnv, people []Person) {
+	out := env.out
+
+	out.Println("Status summary:")
+	for _, row := range statusSummary(people) {
+		out.Printf("  %-8s %d (ages %s)\n", row.Name, row.Count, row.Ages)
+	}
+
+	// Nested literals, with field names omitted and present
+	bands := []struct {
+		Label string
+		Range struct{ Min, Max int }
+	}{
+		{"under 30", struct{ Min, Max int }{0, 29}},
+		{Label: "30 and up", Range: struct{ Min, Max int }{Min: 30, Max: 150}},
+	}
+	for _, band := range bands {
+		n := 0
+		for _, p := range people {
+			if InRange(p.Age, band.Range.Min, band.Range.Max) {
+				n++
+			}
+		}
+		out.Printf("  %-10s %d\n", band.Label+":", n)
+	}
+
+	greeters := make([]interface{ Greet() string }, 0, len(people))
+	for i := range people {
+		greeters = append(greeters, &people[i])
+	}
+	greetAll(out, greeters...)
+}
+
+// Merge, non-blocking operations and a buffered-channel semaphore
+func mergeExample(ctx context.Context, env demoEnv) {
+	out := env.out
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Capacity 1: only one producer runs at a time
+	slots := make(chan struct{}, 1)
+	produce := func(start int) <-chan int {
+		ch := make(chan int)
+		go func() {
+			defer close(ch)
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			for n := start; n < 10; n += 2 {
+				ch <- n
+			}
+		}()
+		return ch
+	}
+
+	var merged []int
+	for n := range Merge(ctx, produce(0), produce(1)) {
+		merged = append(merged, n)
+	}
+	slices.Sort(merged) // arrival order depends on scheduling
+	out.Println("Merged:", merged)
+
+	mailbox := make(chan string, 1)
+	out.Println("First send:", TrySend(mailbox, "hello"))
+	out.Println("Second send:", TrySend(mailbox, "again"))
+	msg, ok := TryReceive(mailbox)
+	out.Printf("Received %q (%t)\n", msg, ok)
+	_, ok = TryReceive(mailbox)
+	out.Println("Empty receive:", ok)
+}
+
+// Every error in a tree, pre-order, following both Unwrap forms
+func errorNodes(err error) []error {
+	if err == nil {
+		return nil
+	}
+	nodes := []error{err}
+	switch e := err.(type) {
+	case interface{ Unwrap() []error }:
+		for _, child := range e.Unwrap() {
+			nodes = append(nodes, errorNodes(child)...)
+		}
+	case interface{ Unwrap() error }:
+		nodes = append(nodes, errorNodes(e.Unwrap())...)
+	}
+	return nodes
+}
+
+// Batch validation failures and a division error joined, then wrapped
+// with a sentinel through a second %w verb
+func sampleErrorTree() error {
+	payloads := [][]byte{
+		[]byte(`{"id": 1, "name": "Ada", "age": 36, "status": "active"}`),
+		[]byte(`{"id": 2, "name": "", "age": 41, "status": "active"}`),
+		[]byte(`{"id": 3, "name": "Bob", "age": 29, "status": "active", "extra": 1}`),
+	}
+	var failed []error
+	for _, err := range ValidatePeopleJSON(payloads) {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	batch := &BatchError{Total: len(payloads), Errors: failed}
+	_, divErr := divide(1, 0)
+	return fmt.Errorf("import run: %w (lookup: %w)", errors.Join(batch, divErr), ErrNotFound)
+}
+
+// errors.Join, multiple %w verbs, errors.Is/As and type switches
+func errorsExample(env demoEnv) {
+	out := env.out
+	err := sampleErrorTree()
+
+	// errors.Is walks the whole tree, through every Unwrap() []error
+	out.Println("Is division by zero:", errors.Is(err, ErrDivisionByZero))
+	out.Println("Is not found:", errors.Is(err, ErrNotFound))
+	out.Println("Is indeterminate:", errors.Is(err, ErrIndeterminate))
+
+	// errors.As into a pointer target (first match, depth-first)...
+	var coded *CodedError
+	if errors.As(err, &coded) {
+		out.Printf("First coded error: %s (%s)\n", coded.Code, coded.Message)
+	}
+	// ...and into an interface target
+	var multi interface{ Unwrap() []error }
+	if errors.As(err, &multi) {
+		out.Printf("Outermost multi-error: %T with %d branches\n", multi, len(multi.Unwrap()))
+	}
+
+	// Type switch over every node of the tree
+	for _, node := range errorNodes(err) {
+		switch e := node.(type) {
+		case *BatchError:
+			out.Printf("  batch: %d of %d failed\n", len(e.Errors), e.Total)
+		case *CodedError:
+			out.Printf("  coded %q: %s\n", e.Code, e.Message)
+		case *FieldError:
+			out.Printf("  field %q: %v\n", e.Field, e.Err)
+		case interface{ Unwrap() error }, interface{ Unwrap() []error }:
+			// Plain wrappers only add context
+		default:
+			out.Printf("  cause: %v\n", e)
+		}
+	}
+}
+
+// Process exit codes
+const (
+	ExitOK      = 0 // success
+	ExitRuntime = 1 // runtime failure
+	ExitUsage   = 2 // bad command-line usage
+	ExitPartial = 3 // batch command finished with some failed items
+)
+
+// Error type for command-line usage mistakes
+type UsageError struct {
+	Msg string
+}
+
+func (e *UsageError) Error() string {
+	return "usage: " + e.Msg
+}
+
+// Error type for batch commands that partially failed
+type BatchError struct {
+	Total  int
+	Errors []error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d of %d items failed: %v", len(e.Errors), e.Total, errors.Join(e.Errors...))
+}
+
+func (e *BatchError) Unwrap() []error {
+	return e.Errors
+}
+
+// Map an error returned by a command to its exit code
+func exitCode(err error) int {
+	var usageErr *UsageError
+	var batchErr *BatchError
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.As(err, &usageErr):
+		return ExitUsage
+	case errors.As(err, &batchErr):
+		return ExitPartial
+	default:
+		return ExitRuntime
+	}
+}
+
+// Subcommands compiled in only under a build tag; their files register
+// them from init
+var optionalCommands = map[string]func(args []string, stdout, stderr io.Writer) error{}
+
+// Single entry point: runs the command selected by args and reports any
+// error on stderr, returning the exit code instead of calling os.Exit
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	var err error
+	switch {
+	case len(args) == 0 || strings.HasPrefix(args[0], "-"):
+		err = runDemoCommand(ctx, args, stdout, stderr)
+	case args[0] == "demo":
+		err = runDemoCommand(ctx, args[1:], stdout, stderr)
+	case args[0] == "seed":
+		err = runSeed(args[1:], stdout, stderr)
+	case args[0] == "version":
+		err = runVersion(args[1:], stdout, stderr)
+	case optionalCommands[args[0]] != nil:
+		err = optionalCommands[args[0]](args[1:], stdout, stderr)
+	default:
+		err = &UsageError{Msg: fmt.Sprintf("unknown command %q", args[0])}
+	}
+
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			fmt.Fprintln(stderr, "demo: interrupted")
+		} else {
+			fmt.Fprintf(stderr, "demo: %v\n", err)
+		}
+	}
+	return exitCode(err)
+}
+
+// Fixed reference point so generated data depends only on the seed
+var datagenEpoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Name, tag and department pools for generated fixtures
+var (
+	firstNames  = []string{"Alice", "Bob", "Charlie", "Dana", "Emil", "Fatima", "Grace", "Hiro", "Ines", "Jonas", "Kemal", "Lena", "Mateo", "Nora", "Oskar", "Priya"}
+	lastNames   = []string{"Smith", "Müller", "Garcia", "Nguyen", "Rossi", "Kowalski", "Okafor", "Tanaka", "Dubois", "Larsen", "Haddad", "Silva"}
+	tagPool     = []string{"developer", "golang", "rust", "ops", "security", "frontend", "data", "oncall", "mentor"}
+	departments = []string{"Engineering", "Security", "Operations", "Sales", "Support"}
+)
+
+// Deterministic fixture generator: the same seed and n always yield the
+// same records
+func GeneratePeople(seed int64, n int) []Person {
+	r := rand.New(rand.NewSource(seed))
+	people := make([]Person, n)
+	for i := range people {
+		first := firstNames[r.Intn(len(firstNames))]
+		last := lastNames[r.Intn(len(lastNames))]
+		id := UserID(i + 1)
+
+		// Roughly normal ages around 38, bounded to working age
+		age := int(r.NormFloat64()*12 + 38)
+		age = Clamp(age, 18, 80)
+
+		var status Status
+		switch roll := r.Intn(10); {
+		case roll < 7:
+			status = StatusActive
+		case roll < 9:
+			status = StatusInactive
+		default:
+			status = StatusPending
+		}
+
+		tags := make([]string, 0, 3)
+		for _, j := range r.Perm(len(tagPool))[:r.Intn(4)] {
+			tags = append(tags, tagPool[j])
+		}
+
+		p := Person{
+			ID:      id,
+			Name:    first + " " + last,
+			Age:     age,
+			Status:  status,
+			Created: datagenEpoch.Add(time.Duration(r.Int63n(int64(365 * 24 * time.Hour)))),
+			Tags:    tags,
+			Metadata: map[string]interface{}{
+				"source": "datagen",
+				"seed":   seed,
+			},
+		}
+		// Roughly one in ten records has no email
+		if r.Intn(10) != 0 {
+			email := fmt.Sprintf("%s.%s%d@example.com", strings.ToLower(first), strings.ToLower(last), id)
+			p.Email = &email
+		}
+		people[i] = p
+	}
+	return people
+}
+
+// Employees built on generated people, with departments and salaries
+func GenerateEmployees(seed int64, n int) []Employee {
+	people := GeneratePeople(seed, n)
+	r := rand.New(rand.NewSource(seed ^ 0x5eed))
+	employees := make([]Employee, n)
+	for i, p := range people {
+		salary := math.Round(max(30000, r.NormFloat64()*15000+65000)*100) / 100
+		employees[i] = Employee{
+			Person:     p,
+			Department: departments[r.Intn(len(departments))],
+			Salary:     salary,
+		}
+	}
+	return employees
+}
+
+// Subcommand writing generated people as a JSON snapshot
+func runSeed(args []string, stdout, stderr io.Writer) (err error) {
+	fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	n := fs.Int("n", 100, "number of records to generate")
+	seed := fs.Int64("seed", 1, "random seed")
+	output := fs.String("o", "", "output file (default stdout)")
+	format := fs.String("format", "json", "output format: json or ndjson")
+	embedded := fs.Bool("embedded", false, "write the embedded seed people instead of generated ones")
+	if err := fs.Parse(args); err != nil {
+		return &UsageError{Msg: err.Error()}
+	}
+	if *format != "json" && *format != "ndjson" {
+		return &UsageError{Msg: fmt.Sprintf("unknown format %q", *format)}
+	}
+	if *n < 0 {
+		return &UsageError{Msg: fmt.Sprintf("-n must not be negative, got %d", *n)}
+	}
+
+	w := stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		w = f
+	}
+	var people []Person
+	if *embedded {
+		if people, err = LoadEmbeddedSeed(); err != nil {
+			return err
 		}
+	} else {
+		people = GeneratePeople(*seed, *n)
+	}
+	if *format == "ndjson" {
+		return EncodeNDJSON(w, slices.Values(people))
+	}
+	return json.NewEncoder(w).Encode(people)
+}
+
+// Set at link time: -ldflags "-X main.buildTime=2006-01-02T15:04:05Z"
+var buildTime string
+
+// Build metadata reported by the version command
+type BuildInfo struct {
+	APIVersion string `json:"api_version"`
+	Module     string `json:"module_version"`
+	Revision   string `json:"vcs_revision,omitempty"`
+	Dirty      bool   `json:"vcs_dirty"`
+	GoVersion  string `json:"go_version"`
+	BuildTime  string `json:"build_time,omitempty"`
+}
+
+// Build info lookup; tests and plain "go run" builds carry no module or
+// VCS data, so those fields fall back to "(devel)" and empty values
+func readBuildInfo() BuildInfo {
+	info := BuildInfo{
+		APIVersion: APIVersion,
+		Module:     "(devel)",
+		GoVersion:  runtime.Version(),
+		BuildTime:  buildTime,
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if bi.Main.Version != "" {
+		info.Module = bi.Main.Version
+	}
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Revision = setting.Value
+		case "vcs.modified":
+			info.Dirty = setting.Value == "true"
+		}
+	}
+	return info
+}
+
+// Default attributes so every log line carries the build's revision;
+// builds without VCS info (tests, go run) log it as "unknown"
+func withBuildAttrs(l *slog.Logger) *slog.Logger {
+	info := readBuildInfo()
+	revision := info.Revision
+	if revision == "" {
+		revision = "unknown"
+	}
+	return l.With(slog.String("revision", revision), slog.Bool("dirty", info.Dirty))
+}
+
+// Subcommand with its own flag set
+func runVersion(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("version", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	format := fs.String("format", "text", "output format: text or json")
+	if err := fs.Parse(args); err != nil {
+		return &UsageError{Msg: err.Error()}
+	}
+
+	info := readBuildInfo()
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	case "text":
+		revision := info.Revision
+		if revision == "" {
+			revision = "unknown"
+		}
+		if info.Dirty {
+			revision += " (dirty)"
+		}
+		built := info.BuildTime
+		if built == "" {
+			built = "unknown"
+		}
+		fmt.Fprintf(stdout, "api version: %s\n", info.APIVersion)
+		fmt.Fprintf(stdout, "module:      %s\n", info.Module)
+		fmt.Fprintf(stdout, "revision:    %s\n", revision)
+		fmt.Fprintf(stdout, "go:          %s\n", info.GoVersion)
+		fmt.Fprintf(stdout, "built:       %s\n", built)
+		return nil
+	default:
+		return &UsageError{Msg: fmt.Sprintf("unknown format %q", *format)}
 	}
 }
 
 // Main function
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	code := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+// Fixed start time for -deterministic runs
+var deterministicEpoch = time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+// demo subcommand; -deterministic makes the output byte-for-byte stable
+func runDemoCommand(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("demo", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	deterministic := fs.Bool("deterministic", false, "use a fake clock and a single worker")
+	if err := fs.Parse(args); err != nil {
+		return &UsageError{Msg: err.Error()}
+	}
+	if fs.NArg() > 0 {
+		return &UsageError{Msg: fmt.Sprintf("unexpected argument %q", fs.Arg(0))}
+	}
+
+	env := demoEnv{out: NewPrinter(stdout), clock: systemClock, workers: 3}
+	if *deterministic {
+		env.clock = NewFakeClock(deterministicEpoch)
+		env.workers = 1
+	}
+	return runDemo(ctx, env)
+}
+
+// Demo body writing to the printer and clock injected through env
+func runDemo(ctx context.Context, env demoEnv) error {
+	out := env.out
+
 	// Basic types
 	var intVar int = 42
 	var floatVar float64 = 3.14159
@@ -252,6 +3981,9 @@ func main() {
 	shortInt := 100
 	shortString := "Short declaration"
 
+	// The samples above are never read; blank them so the package compiles
+	_, _, _, _, _, _, _, _ = intVar, floatVar, boolVar, stringVar, runeVar, byteVar, shortInt, shortString
+
 	// Slice operations
 	numbers := []int{1, 2, 3, 4, 5}
 	doubled := make([]int, len(numbers))
@@ -279,36 +4011,36 @@ func main() {
 	// Control structures
 	for i := 0; i < 10; i++ {
 		if i%2 == 0 {
-			fmt.Printf("Even number: %d\n", i)
+			out.Printf("Even number: %d\n", i)
 		} else {
-			fmt.Printf("Odd number: %d\n", i)
+			out.Printf("Odd number: %d\n", i)
 		}
 	}
 
-	// Range over map
-	for name, age := range ages {
-		fmt.Printf("%s is %d years old\n", name, age)
+	// Range over map (sorted keys keep the output stable)
+	for _, name := range slices.Sorted(maps.Keys(ages)) {
+		out.Printf("%s is %d years old\n", name, ages[name])
 	}
 
 	// Switch statement
-	switch day := time.Now().Weekday(); day {
-	case time.Saturday, time.Sunday:
-		fmt.Println("It's weekend!")
+	switch day := weekdayOf(env.clock.Now()); day {
+	case Saturday, Sunday:
+		out.Printf("It's weekend! (%v)\n", day)
 	default:
-		fmt.Println("It's a weekday")
+		out.Printf("It's a weekday (%v)\n", day)
 	}
 
 	// Type switch
 	var i interface{} = 42
 	switch v := i.(type) {
 	case int:
-		fmt.Printf("Integer: %d\n", v)
+		out.Printf("Integer: %d\n", v)
 	case string:
-		fmt.Printf("String: %s\n", v)
+		out.Printf("String: %s\n", v)
 	case bool:
-		fmt.Printf("Boolean: %t\n", v)
+		out.Printf("Boolean: %t\n", v)
 	default:
-		fmt.Printf("Unknown type: %T\n", v)
+		out.Printf("Unknown type: %T\n", v)
 	}
 
 	// Struct usage
@@ -317,57 +4049,61 @@ func main() {
 		Name:    "Alice",
 		Age:     30,
 		Status:  StatusActive,
-		Created: time.Now(),
+		Created: env.clock.Now(),
 		Tags:    []string{"developer", "golang"},
 		Metadata: map[string]interface{}{
 			"department": "engineering",
 			"level":      "senior",
 		},
+		Permissions: PermRead | PermWrite,
 	}
 
 	// Method calls
-	fmt.Println(person.Greet())
-	fmt.Println("Is adult:", person.IsAdult())
-	person.SetEmail("alice@example.com")
+	out.Println(person.Greet())
+	out.Println("Is adult:", person.IsAdult())
+	out.Printf("Permissions: %v (admin: %t)\n", person.Permissions, person.Permissions.Has(PermAdmin))
+	out.Printf("%s: %d-char banner, %v work week\n", bannerText, bannerWidth, workWeek)
+	if err := person.SetEmail("alice@example.com"); err != nil {
+		return fmt.Errorf("set email: %w", err)
+	}
 
 	// Pointer operations
 	personPtr := &person
-	fmt.Println("Person pointer:", personPtr)
+	out.Println("Person pointer:", personPtr)
 
 	// JSON marshaling
 	jsonData, err := json.MarshalIndent(person, "", "  ")
 	if err != nil {
-		log.Printf("JSON marshal error: %v", err)
-	} else {
-		fmt.Printf("JSON: %s\n", jsonData)
+		return fmt.Errorf("marshal person: %w", err)
 	}
+	out.Printf("JSON: %s\n", jsonData)
 
 	// Error handling
 	result, err := divide(10.0, 2.0)
 	if err != nil {
 		log.Printf("Division error: %v", err)
 	} else {
-		fmt.Printf("Division result: %.2f\n", result)
+		out.Printf("Division result: %.2f\n", result)
 	}
 
 	// Multiple assignment
 	first, second := swap("hello", "world")
-	fmt.Printf("Swapped: %s, %s\n", first, second)
+	out.Printf("Swapped: %s, %s\n", first, second)
 
 	// Variadic function call
 	total := sum(1, 2, 3, 4, 5)
-	fmt.Printf("Sum: %d\n", total)
+	out.Printf("Sum: %d\n", total)
 
 	// Slice unpacking
 	moreNumbers := []int{6, 7, 8, 9, 10}
 	totalWithSlice := sum(moreNumbers...)
-	fmt.Printf("Sum with slice: %d\n", totalWithSlice)
+	out.Printf("Sum with slice: %d\n", totalWithSlice)
 
 	// Anonymous function
 	multiply := func(a, b int) int {
 		return a * b
 	}
-	fmt.Printf("Multiply: %d\n", multiply(5, 3))
+	out.Printf("Multiply: %d\n", multiply(5, 3))
 
 	// Closure
 	counter := 0
@@ -376,24 +4112,24 @@ func main() {
 		return counter
 	}
 
-	fmt.Printf("Counter: %d\n", increment())
-	fmt.Printf("Counter: %d\n", increment())
+	out.Printf("Counter: %d\n", increment())
+	out.Printf("Counter: %d\n", increment())
 
 	// String operations
 	text := "Hello, World!"
-	fmt.Printf("Length: %d\n", len(text))
-	fmt.Printf("Upper: %s\n", strings.ToUpper(text))
-	fmt.Printf("Contains 'World': %t\n", strings.Contains(text, "World"))
+	out.Printf("Length: %d\n", len(text))
+	out.Printf("Upper: %s\n", strings.ToUpper(text))
+	out.Printf("Contains 'World': %t\n", strings.Contains(text, "World"))
 
 	// String conversion
 	numberStr := "123"
 	if num, err := strconv.Atoi(numberStr); err == nil {
-		fmt.Printf("Parsed number: %d\n", num)
+		out.Printf("Parsed number: %d\n", num)
 	}
 
 	// Sort operations
 	sort.Ints(numbers)
-	fmt.Printf("Sorted numbers: %v\n", numbers)
+	out.Printf("Sorted numbers: %v\n", numbers)
 
 	// Sort with custom function
 	people := []Person{
@@ -406,52 +4142,87 @@ func main() {
 		return people[i].Age < people[j].Age
 	})
 
-	fmt.Println("Sorted people by age:")
+	out.Println("Sorted people by age:")
 	for _, p := range people {
-		fmt.Printf("  %s (%d)\n", p.Name, p.Age)
+		out.Printf("  %s (%d)\n", p.Name, p.Age)
 	}
 
 	// Context usage
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	fetchCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	userData, err := fetchUserData(ctx, UserID(1))
+	userData, err := fetchUserData(fetchCtx, env.clock, UserID(1))
 	if err != nil {
-		log.Printf("Fetch error: %v", err)
-	} else {
-		fmt.Printf("User data: %+v\n", userData)
+		return fmt.Errorf("fetch user: %w", err)
 	}
+	out.Printf("User data: %+v\n", userData)
 
 	// Goroutines and channels
-	fmt.Println("Demonstrating channels:")
-	demonstrateChannels()
+	out.Println("Demonstrating channels:")
+	demonstrateChannels(env)
+	pipelined, err := ProcessJobsCtx(ctx, numbers, env.workers)
+	if err != nil {
+		return fmt.Errorf("process jobs: %w", err)
+	}
+	out.Println("Doubled with cancellation support:", pipelined)
 
 	// Select statement
-	fmt.Println("Demonstrating select:")
-	selectExample()
+	out.Println("Demonstrating select:")
+	selectExample(env)
+
+	// Fan-in with nil channels and select default
+	out.Println("Demonstrating merge:")
+	mergeExample(ctx, env)
+
+	// Error trees
+	out.Println("Demonstrating error trees:")
+	errorsExample(env)
+
+	// Range-over-func and newer builtins
+	out.Println("Demonstrating range-over-func:")
+	rangeFuncExample(env)
+
+	// Method values and expressions
+	out.Println("Demonstrating method values:")
+	methodValuesExample(env)
 
 	// Defer usage
-	if err := processFile("test.txt"); err != nil {
-		log.Printf("Process file error: %v", err)
+	if err := processFile(env, "test.txt"); err != nil {
+		return fmt.Errorf("process file: %w", err)
 	}
 
 	// Generic function usage (Go 1.18+)
 	maxInt := FindMax([]int{1, 5, 3, 9, 2}, func(a, b int) bool { return a < b })
-	fmt.Printf("Max integer: %d\n", maxInt)
+	out.Printf("Max integer: %d\n", maxInt)
+
+	// Constraints, generic types and explicit instantiation
+	ids := Stack[UserID]{}
+	ids.Push(UserID(1))
+	ids.Push(UserID(2))
+	if top, ok := ids.Pop(); ok {
+		out.Printf("Popped ID: %d (%d left)\n", top, ids.Len())
+	}
+	sumIDs := SumOf[UserID]
+	out.Printf("Sum of IDs: %d\n", sumIDs(1, 2, 3))
+	out.Printf("Sum of floats: %.1f\n", SumOf(1.5, 2.5))
+	out.Println("Statuses:", JoinAs([]Status{StatusActive, StatusPending}, ", "))
+	for _, pair := range SortedPairs(ages) {
+		out.Printf("Pair: %s=%d\n", pair.Key, pair.Value)
+	}
 
 	// Interface usage
 	var greeter Greeter = &person
-	fmt.Println("Interface greeting:", greeter.Greet())
+	out.Println("Interface greeting:", greeter.Greet())
 
 	// Type assertion
 	if p, ok := greeter.(*Person); ok {
-		fmt.Printf("Type assertion successful: %s\n", p.Name)
+		out.Printf("Type assertion successful: %s\n", p.Name)
 	}
 
 	// Empty interface
 	var empty interface{}
 	empty = 42
-	fmt.Printf("Empty interface value: %v\n", empty)
+	out.Printf("Empty interface value: %v\n", empty)
 
 	// Embedded struct
 	employee := Employee{
@@ -465,13 +4236,63 @@ func main() {
 		Salary:     75000.0,
 	}
 
-	fmt.Println(employee.GetFullInfo())
-	fmt.Println("Employee greeting:", employee.Greet()) // Inherited method
+	out.Println(employee.GetFullInfo())
+	out.Println("Employee greeting:", employee.Greet()) // Inherited method
+
+	// Platform- and cgo-specific helpers (see the test_*.go files)
+	out.Println("Shell:", strings.Join(shellCommand("echo hi"), " "))
+	out.Printf("Name hash: %08x\n", namehash.Sum(employee.Name))
+
+	// Literal forms
+	out.Printf("Literal checksum: %08x, |(3+4i)i| = %.1f\n", literalChecksum(), complexMagnitude())
+
+	// Struct tags read through reflection
+	specs, err := ColumnSpecs(&ConfigRecord{})
+	if err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		out.Printf("Column %s (%s): pk=%t required=%t redacted=%t doc=%q\n",
+			spec.Column, spec.Field, spec.PrimaryKey, spec.Required, spec.Redacted, spec.Doc)
+	}
+
+	// Embedded assets
+	seedFiles, err := embeddedSeedFiles()
+	if err != nil {
+		return err
+	}
+	seedPeople, err := LoadEmbeddedSeed()
+	if err != nil {
+		return err
+	}
+	out.Printf("Embedded seed %v: %d people\n", seedFiles, len(seedPeople))
+	for _, p := range seedPeople {
+		greeting, err := p.Render(greetingTemplate)
+		if err != nil {
+			return err
+		}
+		out.Printf("%s", greeting)
+	}
+	anonymousTypesExample(env, seedPeople)
+
+	// Aliases are interchangeable with their targets; definitions need a
+	// conversion
+	var grace Duration = 1500 * time.Millisecond
+	var wait time.Duration = grace
+	out.Printf("Alias: %v (%.1fs), defined: %v\n", wait, grace.Seconds(), Timeout(grace))
+	var counts map[Status]int = Histogram(seedPeople, func(p Person) Status { return p.Status })
+	out.Println("Histogram via Table alias:", counts)
+
+	// Labeled search
+	if p, ok := FindFirstAdultWithTag([]Person{employee.Person, person}, "GoLang"); ok {
+		out.Println("First adult gopher:", p.Name)
+	}
 
-	fmt.Println("Program completed successfully!")
+	out.Println("Program completed successfully!")
+	return nil
 }
 
-// init function
+// init function (stderr keeps machine-readable stdout clean)
 func init() {
-	fmt.Println("Package initialized")
+	fmt.Fprintln(os.Stderr, "Package initialized")
 }
@@ -0,0 +1,133 @@
+//go:build layout
+
+// Struct layout introspection, opt-in via: go build -tags layout
+//
+// Aliasing rules followed below (see the unsafe package docs):
+//   - uintptr is just a number: the GC does not track it, so a
+//     Pointer -> uintptr -> Pointer round trip must happen within a single
+//     expression, never via a uintptr variable.
+//   - unsafe.Add is the preferred way to offset a pointer and must stay
+//     inside the original allocation.
+//   - unsafe.Slice(unsafe.StringData(s), len(s)) aliases the string's
+//     bytes, which must never be written.
+//   - unsafe.String(&b[0], len(b)) aliases the slice, which must not be
+//     modified while the string is in use.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"reflect"
+	"unsafe"
+)
+
+func init() {
+	optionalCommands["layout"] = runLayout
+}
+
+// Offset of one field, computed both ways
+type fieldLayout struct {
+	Name    string
+	Unsafe  uintptr
+	Reflect uintptr
+}
+
+func personLayout() []fieldLayout {
+	var p Person
+	t := reflect.TypeOf(p)
+	offsets := []struct {
+		name   string
+		offset uintptr
+	}{
+		{"ID", unsafe.Offsetof(p.ID)},
+		{"Name", unsafe.Offsetof(p.Name)},
+		{"Age", unsafe.Offsetof(p.Age)},
+		{"BirthDate", unsafe.Offsetof(p.BirthDate)},
+		{"Email", unsafe.Offsetof(p.Email)},
+		{"Status", unsafe.Offsetof(p.Status)},
+		{"Created", unsafe.Offsetof(p.Created)},
+		{"Tags", unsafe.Offsetof(p.Tags)},
+		{"Metadata", unsafe.Offsetof(p.Metadata)},
+		{"Permissions", unsafe.Offsetof(p.Permissions)},
+	}
+
+	layout := make([]fieldLayout, len(offsets))
+	for i, o := range offsets {
+		layout[i] = fieldLayout{Name: o.name, Unsafe: o.offset}
+		if f, ok := t.FieldByName(o.name); ok {
+			layout[i].Reflect = f.Offset
+		}
+	}
+	return layout
+}
+
+func employeeLayout() []fieldLayout {
+	var e Employee
+	t := reflect.TypeOf(e)
+	offsets := []struct {
+		name   string
+		offset uintptr
+	}{
+		{"Person", unsafe.Offsetof(e.Person)},
+		{"Department", unsafe.Offsetof(e.Department)},
+		{"Salary", unsafe.Offsetof(e.Salary)},
+	}
+
+	layout := make([]fieldLayout, len(offsets))
+	for i, o := range offsets {
+		layout[i] = fieldLayout{Name: o.name, Unsafe: o.offset}
+		if f, ok := t.FieldByName(o.name); ok {
+			layout[i].Reflect = f.Offset
+		}
+	}
+	return layout
+}
+
+// Prints size, alignment and offsets; fails if unsafe and reflect
+// disagree, or if reflect sees a field the unsafe table is missing
+func runLayout(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("layout", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	if err := fs.Parse(args); err != nil {
+		return &UsageError{Msg: err.Error()}
+	}
+
+	types := []struct {
+		value  any
+		size   uintptr
+		align  uintptr
+		fields []fieldLayout
+	}{
+		{Person{}, unsafe.Sizeof(Person{}), unsafe.Alignof(Person{}), personLayout()},
+		{Employee{}, unsafe.Sizeof(Employee{}), unsafe.Alignof(Employee{}), employeeLayout()},
+	}
+	for _, typ := range types {
+		t := reflect.TypeOf(typ.value)
+		fmt.Fprintf(stdout, "%s: size %d (reflect %d), align %d (reflect %d)\n",
+			t.Name(), typ.size, t.Size(), typ.align, t.Align())
+		if t.NumField() != len(typ.fields) {
+			return fmt.Errorf("%s has %d fields, layout table lists %d", t.Name(), t.NumField(), len(typ.fields))
+		}
+		for _, f := range typ.fields {
+			fmt.Fprintf(stdout, "  %-12s offset %3d\n", f.Name, f.Unsafe)
+			if f.Unsafe != f.Reflect {
+				return fmt.Errorf("%s.%s: unsafe offset %d, reflect offset %d", t.Name(), f.Name, f.Unsafe, f.Reflect)
+			}
+		}
+	}
+
+	// Pointer arithmetic: the uintptr form is legal only as one expression
+	p := Person{Name: "Ada", Age: 36}
+	agePtr := (*int)(unsafe.Add(unsafe.Pointer(&p), unsafe.Offsetof(p.Age)))
+	namePtr := (*string)(unsafe.Pointer(uintptr(unsafe.Pointer(&p)) + unsafe.Offsetof(p.Name)))
+	fmt.Fprintf(stdout, "Via pointers: %s is %d\n", *namePtr, *agePtr)
+
+	// Zero-copy conversions in both directions
+	nameBytes := unsafe.Slice(unsafe.StringData(p.Name), len(p.Name))
+	buf := []byte("Grace")
+	alias := unsafe.String(&buf[0], len(buf))
+	fmt.Fprintf(stdout, "Aliased bytes %v, aliased string %q\n", nameBytes, alias)
+	return nil
+}
@@ -0,0 +1,46 @@
+//go:build layout
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Fails when a field is reordered, added or removed without the unsafe
+// tables in test_layout.go following along
+func TestLayoutOffsetsAgree(t *testing.T) {
+	for _, tt := range []struct {
+		typ    reflect.Type
+		fields []fieldLayout
+	}{
+		{reflect.TypeFor[Person](), personLayout()},
+		{reflect.TypeFor[Employee](), employeeLayout()},
+	} {
+		if tt.typ.NumField() != len(tt.fields) {
+			t.Errorf("%s has %d fields, layout table lists %d", tt.typ.Name(), tt.typ.NumField(), len(tt.fields))
+		}
+		for i, f := range tt.fields {
+			if f.Unsafe != f.Reflect {
+				t.Errorf("%s.%s: unsafe offset %d, reflect offset %d", tt.typ.Name(), f.Name, f.Unsafe, f.Reflect)
+			}
+			if i < tt.typ.NumField() && tt.typ.Field(i).Name != f.Name {
+				t.Errorf("%s field %d is %s, layout table lists %s", tt.typ.Name(), i, tt.typ.Field(i).Name, f.Name)
+			}
+		}
+	}
+}
+
+func TestLayoutCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if err := runLayout(nil, &stdout, &stderr); err != nil {
+		t.Fatalf("layout: %v\n%s", err, stderr.String())
+	}
+	for _, want := range []string{"Person: size", "Employee: size", "Via pointers: Ada is 36", `aliased string "Grace"`} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, stdout.String())
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build linux
+
+package main
+
+// Command prefix for running a shell snippet on Linux
+func shellCommand(script string) []string {
+	return []string{"/bin/sh", "-c", script}
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !windows
+
+package main
+
+// Fallback for every other platform: assume a POSIX shell
+func shellCommand(script string) []string {
+	return []string{"sh", "-c", script}
+}
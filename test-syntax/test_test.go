@@ -0,0 +1,3410 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"maps"
+	"math"
+	mathrand "math/rand"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDivide(t *testing.T) {
+	inf := math.Inf(1)
+	tests := []struct {
+		name    string
+		a, b    float64
+		want    float64
+		wantErr error
+	}{
+		{"simple", 10, 2, 5, nil},
+		{"negative", -9, 3, -3, nil},
+		{"zero numerator", 0, 5, 0, nil},
+		{"zero denominator", 1, 0, 0, ErrDivisionByZero},
+		{"zero over zero", 0, 0, 0, ErrDivisionByZero},
+		{"negative zero denominator", 1, math.Copysign(0, -1), 0, ErrDivisionByZero},
+		{"inf numerator", inf, 2, inf, nil},
+		{"negative inf numerator", -inf, 2, -inf, nil},
+		{"inf denominator", 1, inf, 0, nil},
+		{"inf over inf", inf, inf, 0, ErrIndeterminate},
+		{"inf over negative inf", inf, -inf, 0, ErrIndeterminate},
+		{"nan operand", math.NaN(), 1, 0, ErrIndeterminate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := divide(tt.a, tt.b)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("divide(%v, %v) error = %v, want %v", tt.a, tt.b, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("divide(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDivideErrorIdentity(t *testing.T) {
+	_, err := divide(1, 0)
+	if err != ErrDivisionByZero {
+		t.Errorf("zero denominator returned %v, want the ErrDivisionByZero sentinel itself", err)
+	}
+	_, err = divide(math.Inf(1), math.Inf(1))
+	if errors.Is(err, ErrDivisionByZero) {
+		t.Errorf("Inf/Inf error %v matches ErrDivisionByZero", err)
+	}
+}
+
+func TestSwap(t *testing.T) {
+	tests := []struct {
+		x, y string
+	}{
+		{"hello", "world"},
+		{"", "right"},
+		{"left", ""},
+		{"", ""},
+		{"héllo", "🚀 wörld"},
+		{"same", "same"},
+	}
+	for _, tt := range tests {
+		first, second := swap(tt.x, tt.y)
+		if first != tt.y || second != tt.x {
+			t.Errorf("swap(%q, %q) = %q, %q", tt.x, tt.y, first, second)
+		}
+	}
+}
+
+func TestSum(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []int
+		want int
+	}{
+		{"no args", nil, 0},
+		{"single", []int{7}, 7},
+		{"several", []int{1, 2, 3, 4, 5}, 15},
+		{"mixed signs", []int{-3, 3, -1}, -1},
+		{"max int", []int{math.MaxInt, 0}, math.MaxInt},
+		{"max then min", []int{math.MaxInt, math.MinInt}, -1},
+		{"wraps past max", []int{math.MaxInt, 1}, math.MinInt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sum(tt.in...); got != tt.want {
+				t.Errorf("sum(%v...) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+
+	if got := sum(); got != 0 {
+		t.Errorf("sum() = %d, want 0", got)
+	}
+	if got := sum(1, 2, 3); got != 6 {
+		t.Errorf("sum(1, 2, 3) = %d, want 6", got)
+	}
+}
+
+func TestFindMaxMin(t *testing.T) {
+	less := func(a, b float64) bool { return a < b }
+	nan := math.NaN()
+	tests := []struct {
+		name     string
+		in       []float64
+		max, min float64
+	}{
+		{"empty", nil, 0, 0},
+		{"single", []float64{4}, 4, 4},
+		{"duplicate max", []float64{1, 9, 3, 9}, 9, 1},
+		{"negatives", []float64{-5, -1, -3}, -1, -5},
+		{"nan first", []float64{nan, 2, 1}, 2, 1},
+		{"nan middle", []float64{1, nan, 3}, 3, 1},
+		{"all nan", []float64{nan, nan}, 0, 0},
+		{"infinities", []float64{math.Inf(-1), 0, math.Inf(1)}, math.Inf(1), math.Inf(-1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FindMax(tt.in, less); got != tt.max {
+				t.Errorf("FindMax(%v) = %v, want %v", tt.in, got, tt.max)
+			}
+			if got := FindMin(tt.in, less); got != tt.min {
+				t.Errorf("FindMin(%v) = %v, want %v", tt.in, got, tt.min)
+			}
+		})
+	}
+}
+
+func TestFindMaxReturnsFirstMaximal(t *testing.T) {
+	type scored struct {
+		name  string
+		score int
+	}
+	items := []scored{{"a", 1}, {"b", 5}, {"c", 5}}
+	got := FindMax(items, func(x, y scored) bool { return x.score < y.score })
+	if got.name != "b" {
+		t.Errorf("FindMax picked %q, want the first maximal element %q", got.name, "b")
+	}
+}
+
+func TestDecodePersonCoerceNumbers(t *testing.T) {
+	opts := DecodeOptions{CoerceNumbers: true}
+
+	p, err := DecodePerson([]byte(`{"id":"7","name":"Ann","age":"30","status":"active"}`), opts)
+	if err != nil {
+		t.Fatalf("DecodePerson: %v", err)
+	}
+	if p.ID != 7 || p.Age != 30 {
+		t.Errorf("got id=%d age=%d, want id=7 age=30", p.ID, p.Age)
+	}
+
+	_, err = DecodePerson([]byte(`{"name":"Ann","age":"x","status":"active"}`), opts)
+	var fe *FieldError
+	if !errors.As(err, &fe) || fe.Field != "age" {
+		t.Fatalf("age \"x\": error = %v, want a FieldError for age", err)
+	}
+	var ce *CodedError
+	if !errors.As(err, &ce) || ce.Code != CodeInvalid {
+		t.Errorf("age \"x\": error = %v, want code %q", err, CodeInvalid)
+	}
+
+	if _, err := DecodePerson([]byte(`{"name":"Ann","age":"30","status":"active"}`), DecodeOptions{}); err == nil {
+		t.Error("string age decoded without CoerceNumbers")
+	}
+}
+
+func TestDecodePeopleStreamCoerceNumbers(t *testing.T) {
+	inputs := map[string]string{
+		"array":  `[{"id":"1","name":"Ann","age":"30","status":"active"},{"id":2,"name":"Bo","age":"41","status":"pending"}]`,
+		"ndjson": "{\"id\":\"1\",\"name\":\"Ann\",\"age\":\"30\",\"status\":\"active\"}\n{\"id\":2,\"name\":\"Bo\",\"age\":\"41\",\"status\":\"pending\"}\n",
+	}
+	for name, in := range inputs {
+		t.Run(name, func(t *testing.T) {
+			var ages []int
+			err := DecodePeopleStream(strings.NewReader(in), DecodeOptions{Strict: true, CoerceNumbers: true}, func(p Person) error {
+				ages = append(ages, p.Age)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("DecodePeopleStream: %v", err)
+			}
+			if len(ages) != 2 || ages[0] != 30 || ages[1] != 41 {
+				t.Errorf("ages = %v, want [30 41]", ages)
+			}
+		})
+	}
+
+	err := DecodePeopleStream(strings.NewReader(`[{"name":"Ann","age":"x","status":"active"}]`), DecodeOptions{CoerceNumbers: true}, func(Person) error { return nil })
+	var fe *FieldError
+	if !errors.As(err, &fe) || fe.Field != "age" || !strings.Contains(err.Error(), "element 0") {
+		t.Errorf("error = %v, want element 0 with a FieldError for age", err)
+	}
+}
+
+func TestDistributeBonusSumsToPool(t *testing.T) {
+	staff := func(salaries ...float64) []Employee {
+		es := make([]Employee, len(salaries))
+		for i, s := range salaries {
+			es[i] = Employee{Person: Person{ID: UserID(i + 1)}, Salary: s}
+		}
+		return es
+	}
+	tests := []struct {
+		name      string
+		employees []Employee
+		pool      float64
+		want      map[UserID]int64
+	}{
+		{"equal salaries, rounded up", staff(100, 100, 100, 100), 0.03, map[UserID]int64{1: 0, 2: 1, 3: 1, 4: 1}},
+		{"float salaries", staff(0.1, 0.2), 0.3, map[UserID]int64{1: 10, 2: 20}},
+		{"thirds", staff(1, 1, 1), 100, map[UserID]int64{1: 3334, 2: 3333, 3: 3333}},
+		{"remainder to highest earner", staff(1, 2, 2), 0.01, map[UserID]int64{1: 0, 2: 1, 3: 0}},
+		{"zero salary", staff(0, 50000), 1000, map[UserID]int64{1: 0, 2: 100000}},
+		{"uneven", staff(52000, 61000, 87000), 12345.67, map[UserID]int64{1: 320987, 2: 376543, 3: 537037}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cents, err := DistributeBonusCents(tt.employees, tt.pool)
+			if err != nil {
+				t.Fatalf("DistributeBonusCents: %v", err)
+			}
+			var total int64
+			for id, c := range cents {
+				if c < 0 {
+					t.Errorf("employee %d got negative share %d", id, c)
+				}
+				total += c
+			}
+			if want := int64(math.Round(tt.pool * 100)); total != want {
+				t.Errorf("shares sum to %d cents, want %d", total, want)
+			}
+			if tt.want != nil && !maps.Equal(cents, tt.want) {
+				t.Errorf("shares = %v, want %v", cents, tt.want)
+			}
+
+			shares, err := DistributeBonus(tt.employees, tt.pool)
+			if err != nil {
+				t.Fatalf("DistributeBonus: %v", err)
+			}
+			for id, c := range cents {
+				if got := int64(math.Round(shares[id] * 100)); got != c {
+					t.Errorf("employee %d: DistributeBonus share %v, want %d cents", id, shares[id], c)
+				}
+			}
+		})
+	}
+}
+
+func TestDistributeBonusErrors(t *testing.T) {
+	one := []Employee{{Person: Person{ID: 1}, Salary: 10}}
+	tests := []struct {
+		name      string
+		employees []Employee
+		pool      float64
+	}{
+		{"zero pool", one, 0},
+		{"negative pool", one, -5},
+		{"nan pool", one, math.NaN()},
+		{"inf pool", one, math.Inf(1)},
+		{"no employees", nil, 10},
+		{"zero total", []Employee{{Person: Person{ID: 1}}}, 10},
+		{"pool too small to round", []Employee{{Person: Person{ID: 1}, Salary: 1}, {Person: Person{ID: 2}, Salary: 1}, {Person: Person{ID: 3}, Salary: 1}, {Person: Person{ID: 4}, Salary: 1}}, 0.02},
+		{"negative salary", []Employee{{Person: Person{ID: 1}, Salary: -1}}, 10},
+		{"duplicate id", append(one, one[0]), 10},
+	}
+	for _, tt := range tests {
+		if _, err := DistributeBonus(tt.employees, tt.pool); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestAuditedPersonRecordsEmailChange(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, time.March, 1, 9, 0, 0, 0, time.UTC))
+	trail := &AuditTrail{}
+	a := NewAuditedPersonWithOptions(Person{ID: 42, Name: "Ann", Status: StatusActive}, trail.Sink(), AuditOptions{Clock: clock})
+
+	if err := a.SetEmail("ann@example.com"); err != nil {
+		t.Fatalf("SetEmail: %v", err)
+	}
+	if err := a.SetEmail("ann@example.com"); err != nil {
+		t.Fatalf("SetEmail again: %v", err)
+	}
+	if err := a.SetEmail("not-an-email"); err == nil {
+		t.Fatal("SetEmail accepted an invalid address")
+	}
+	a.Close()
+
+	want := []Change{{At: clock.Now(), Field: "email", Old: nil, New: "ann@example.com"}}
+	if got := trail.Changes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("changes = %+v, want %+v", got, want)
+	}
+}
+
+func TestAuditedPersonStalledSinkLosesNothing(t *testing.T) {
+	base := time.Date(2024, time.March, 1, 9, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(base)
+	release := make(chan struct{})
+	var stamps []time.Time
+	a := NewAuditedPersonWithOptions(Person{ID: 1, Name: "Ann"}, func(_ UserID, at time.Time, _ string, _, _ interface{}) {
+		<-release
+		stamps = append(stamps, at)
+	}, AuditOptions{Clock: clock})
+
+	const changes = auditBuffer * 3
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range changes {
+			a.AddTag(strconv.Itoa(i))
+			clock.Advance(time.Second)
+		}
+	}()
+	select {
+	case <-done:
+		t.Fatal("setters finished while the sink was stalled; changes must have been lost")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	<-done
+	a.Close()
+	if got := a.Dropped(); got != 0 {
+		t.Errorf("dropped %d changes, want 0", got)
+	}
+	if len(stamps) != changes {
+		t.Fatalf("sink saw %d changes, want %d", len(stamps), changes)
+	}
+	// Each change carries the time it was made, not the time it arrived
+	for i, at := range stamps {
+		if want := base.Add(time.Duration(i) * time.Second); !at.Equal(want) {
+			t.Fatalf("change %d stamped %v, want %v", i, at, want)
+		}
+	}
+}
+
+func TestAuditedPersonMaxWaitDropsAndLogs(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(io.Discard)
+
+	release := make(chan struct{})
+	var delivered atomic.Int64
+	a := NewAuditedPersonWithOptions(Person{ID: 1, Name: "Ann"}, func(UserID, time.Time, string, interface{}, interface{}) {
+		<-release
+		delivered.Add(1)
+	}, AuditOptions{MaxWait: time.Millisecond})
+
+	const changes = auditBuffer * 3
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range changes {
+			a.AddTag(strconv.Itoa(i))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("AddTag waited past MaxWait behind a stalled sink")
+	}
+
+	close(release)
+	a.Close()
+	if got := delivered.Load() + a.Dropped(); got != changes {
+		t.Errorf("delivered %d + dropped %d = %d, want %d", delivered.Load(), a.Dropped(), got, changes)
+	}
+	if a.Dropped() == 0 {
+		t.Error("expected a stalled sink to cause dropped entries")
+	}
+
+	a.AddTag("after close")
+	if got := a.Dropped(); got == 0 || delivered.Load()+got != changes+1 {
+		t.Errorf("change after Close was not counted as dropped")
+	}
+	if got := int64(strings.Count(logged.String(), "audit: dropped tags change of user 1")); got != a.Dropped() {
+		t.Errorf("logged %d drops, want one per dropped change (%d)", got, a.Dropped())
+	}
+}
+
+func TestAuditedPersonSinkPanicIsContained(t *testing.T) {
+	var fields []string
+	a := NewAuditedPerson(Person{ID: 1, Name: "Ann", Status: StatusActive}, func(_ UserID, _ time.Time, field string, _, _ interface{}) {
+		if field == "tags" {
+			panic("sink failure")
+		}
+		fields = append(fields, field)
+	})
+	a.AddTag("x")
+	if err := a.TransitionTo(StatusInactive); err != nil {
+		t.Fatalf("TransitionTo: %v", err)
+	}
+	a.Close()
+	a.Close()
+
+	if !slices.Equal(fields, []string{"status"}) {
+		t.Errorf("delivered fields = %v, want [status]", fields)
+	}
+	if got := a.Person().Tags; !slices.Equal(got, []string{"x"}) {
+		t.Errorf("tags = %v, want [x]", got)
+	}
+}
+
+func TestLoggedFetchLogsRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	saved := logger
+	logger = withBuildAttrs(slog.New(slog.NewJSONHandler(&buf, nil)))
+	defer func() { logger = saved }()
+
+	ctx := WithRequestID(context.Background(), "req-123")
+	if _, err := LoggedFetch(ctx, 7); err != nil {
+		t.Fatalf("LoggedFetch: %v", err)
+	}
+
+	var records []map[string]any
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var rec map[string]any
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("decoding log output: %v", err)
+		}
+		records = append(records, rec)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d log records, want 2 (start and finish)", len(records))
+	}
+	for _, rec := range records {
+		if rec["request_id"] != "req-123" {
+			t.Errorf("%v: request_id = %v, want req-123", rec["msg"], rec["request_id"])
+		}
+		if rec["user_id"] != float64(7) {
+			t.Errorf("%v: user_id = %v, want 7", rec["msg"], rec["user_id"])
+		}
+		if rev, _ := rec["revision"].(string); rev == "" {
+			t.Errorf("%v: missing revision attribute", rec["msg"])
+		}
+	}
+	if _, ok := records[1]["duration"]; !ok {
+		t.Error("finish record has no duration")
+	}
+}
+
+// Valid document the corruption catalog starts from
+const validPersonJSON = `{"id":1,"name":"Alice","age":30,"birth_date":"1994-05-02T00:00:00Z","email":"alice@example.com","status":"active","created":"2024-01-01T09:00:00Z","tags":["golang"],"metadata":{"level":"senior"},"permissions":3}`
+
+func TestPersonCorruptionsAreRejected(t *testing.T) {
+	set := func(field string, v any) func(map[string]any) {
+		return func(doc map[string]any) { doc[field] = v }
+	}
+	drop := func(field string) func(map[string]any) {
+		return func(doc map[string]any) { delete(doc, field) }
+	}
+	tests := []struct {
+		name    string
+		corrupt func(map[string]any)
+		field   string
+		byStage string // "decode" or "validate"
+	}{
+		// wrong types per field
+		{"id as string", set("id", "1"), "id", "decode"},
+		{"id as float", set("id", 1.5), "id", "decode"},
+		{"name as number", set("name", 7), "name", "decode"},
+		{"age as string", set("age", "30"), "age", "decode"},
+		{"age as bool", set("age", true), "age", "decode"},
+		{"email as number", set("email", 5), "email", "decode"},
+		{"status as number", set("status", 1), "status", "decode"},
+		{"created as number", set("created", 5), "created", "decode"},
+		{"created not a timestamp", set("created", "yesterday"), "created", "decode"},
+		{"birth date not a timestamp", set("birth_date", "1994-13-40"), "birth_date", "decode"},
+		{"tags as string", set("tags", "golang"), "tags", "decode"},
+		{"tags with number", set("tags", []any{1}), "tags.0", "decode"},
+		{"metadata as array", set("metadata", []any{}), "metadata", "decode"},
+		{"permissions as string", set("permissions", "read"), "permissions", "decode"},
+
+		// out-of-range numbers
+		{"negative id", set("id", -1), "id", "validate"},
+		{"negative age", set("age", -1), "age", "validate"},
+		{"age too large", set("age", 151), "age", "validate"},
+		{"age overflows int", set("age", 1e30), "age", "decode"},
+		{"permissions overflow uint8", set("permissions", 256), "permissions", "decode"},
+
+		// invalid enum values
+		{"unknown status", set("status", "retired"), "status", "validate"},
+		{"status wrong case", set("status", "Active"), "status", "validate"},
+		{"unknown permission bits", set("permissions", 0x30), "permissions", "validate"},
+
+		// truncated strings
+		{"empty name", set("name", ""), "name", "validate"},
+		{"blank name", set("name", "  "), "name", "validate"},
+		{"empty email", set("email", ""), "email", "validate"},
+		{"email without domain", set("email", "alice@"), "email", "validate"},
+		{"email without at", set("email", "alice"), "email", "validate"},
+		{"email without local part", set("email", "@example.com"), "email", "validate"},
+		{"empty status", set("status", ""), "status", "validate"},
+
+		// null or missing where required
+		{"null id", set("id", nil), "id", "decode"},
+		{"null name", set("name", nil), "name", "decode"},
+		{"null age", set("age", nil), "age", "decode"},
+		{"null status", set("status", nil), "status", "decode"},
+		{"missing id", drop("id"), "id", "decode"},
+		{"missing age", drop("age"), "age", "decode"},
+		{"missing status", drop("status"), "status", "decode"},
+
+		// extra unknown fields
+		{"unknown field", set("role", "admin"), "role", "decode"},
+		{"misspelled field", set("emial", "alice@example.com"), "emial", "decode"},
+	}
+
+	if errs := ValidatePeopleJSON([][]byte{[]byte(validPersonJSON)}); errs[0] != nil {
+		t.Fatalf("base document rejected: %v", errs[0])
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var doc map[string]any
+			if err := json.Unmarshal([]byte(validPersonJSON), &doc); err != nil {
+				t.Fatal(err)
+			}
+			tt.corrupt(doc)
+			data, err := json.Marshal(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p, decodeErr := StrictDecodePerson(data)
+			switch {
+			case tt.byStage == "decode" && decodeErr == nil:
+				t.Fatalf("strict decode accepted %s", data)
+			case tt.byStage == "validate" && decodeErr != nil:
+				t.Fatalf("strict decode rejected %s, want Validate to: %v", data, decodeErr)
+			case tt.byStage == "validate" && p.Validate() == nil:
+				t.Fatalf("Validate accepted %s", data)
+			}
+
+			err = ValidatePeopleJSON([][]byte{data})[0]
+			var ce *CodedError
+			if !errors.As(err, &ce) || ce.Code != CodeInvalid {
+				t.Errorf("error %v, want code %q", err, CodeInvalid)
+			}
+			var fe *FieldError
+			if !errors.As(err, &fe) || fe.Field != tt.field {
+				t.Errorf("error %v, want field %q", err, tt.field)
+			}
+		})
+	}
+}
+
+func TestTruncatedPersonJSONIsRejected(t *testing.T) {
+	for n := range len(validPersonJSON) {
+		data := []byte(validPersonJSON[:n])
+		err := ValidatePeopleJSON([][]byte{data})[0]
+		var ce *CodedError
+		if !errors.As(err, &ce) || ce.Code != CodeInvalid {
+			t.Fatalf("truncated to %d bytes %q: error %v, want code %q", n, data, err, CodeInvalid)
+		}
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite golden files in testdata")
+
+// Serializes -update writes so parallel tests sharing a golden file do not
+// interleave
+var goldenMu sync.Mutex
+
+// Compares got with testdata/name, rewriting the file under -update. Line
+// endings are normalized on both sides so a CRLF checkout still matches
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	got = bytes.ReplaceAll(got, []byte("\r\n"), []byte("\n"))
+	if *update {
+		goldenMu.Lock()
+		defer goldenMu.Unlock()
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	want = bytes.ReplaceAll(want, []byte("\r\n"), []byte("\n"))
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s (run go test -update to accept):\n%s", path, lineDiff(string(want), string(got)))
+	}
+}
+
+// Unified-style line diff (-want +got) with two lines of context around
+// each change; golden files are small, so a quadratic LCS is fine
+func lineDiff(want, got string) string {
+	split := func(s string) []string {
+		lines := strings.SplitAfter(s, "\n")
+		if lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+		return lines
+	}
+	a, b := split(want), split(got)
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	type line struct {
+		op   byte
+		text string
+	}
+	var lines []line
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, line{' ', a[i]})
+			i, j = i+1, j+1
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, line{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, line{'+', b[j]})
+			j++
+		}
+	}
+
+	const context = 2
+	var out strings.Builder
+	lastShown := -1
+	for k, l := range lines {
+		near := false
+		for d := max(0, k-context); d <= min(len(lines)-1, k+context); d++ {
+			if lines[d].op != ' ' {
+				near = true
+				break
+			}
+		}
+		if !near {
+			continue
+		}
+		if lastShown >= 0 && k > lastShown+1 {
+			out.WriteString("...\n")
+		}
+		lastShown = k
+		text := l.text
+		if !strings.HasSuffix(text, "\n") {
+			text += "\n\\ no newline at end\n"
+		}
+		out.WriteByte(l.op)
+		out.WriteString(text)
+	}
+	return out.String()
+}
+
+func TestLineDiff(t *testing.T) {
+	want := "a\nb\nc\nd\ne\nf\ng\n"
+	got := "a\nb\nc\nD\ne\nf\ng\nh\n"
+	diff := lineDiff(want, got)
+	wantDiff := "" +
+		" b\n" +
+		" c\n" +
+		"-d\n" +
+		"+D\n" +
+		" e\n" +
+		" f\n" +
+		" g\n" +
+		"+h\n"
+	if diff != wantDiff {
+		t.Errorf("lineDiff =\n%s\nwant\n%s", diff, wantDiff)
+	}
+	if d := lineDiff("x\n", "x\n"); d != "" {
+		t.Errorf("lineDiff of equal input = %q, want empty", d)
+	}
+}
+
+func TestDemoOutputGolden(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := run(context.Background(), []string{"demo", "-deterministic"}, &stdout, &stderr); code != ExitOK {
+		t.Fatalf("exit code %d, stderr:\n%s", code, stderr.String())
+	}
+	if stderr.Len() > 0 {
+		t.Errorf("unexpected stderr output:\n%s", stderr.String())
+	}
+	golden(t, "demo.golden", stdout.Bytes())
+}
+
+// Map iteration order changes between runs, so one golden match can pass
+// by luck; repeated runs must agree byte for byte and never sleep for real
+func TestDemoDeterministicRepeatable(t *testing.T) {
+	var first []byte
+	start := time.Now()
+	for i := range 5 {
+		var stdout, stderr bytes.Buffer
+		if code := run(context.Background(), []string{"demo", "-deterministic"}, &stdout, &stderr); code != ExitOK {
+			t.Fatalf("run %d: exit code %d, stderr:\n%s", i, code, stderr.String())
+		}
+		if i == 0 {
+			first = stdout.Bytes()
+			continue
+		}
+		if !bytes.Equal(stdout.Bytes(), first) {
+			t.Fatalf("run %d differs from the first:\n%s", i, lineDiff(string(first), stdout.String()))
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("five deterministic demos took %v; something sleeps on the real clock", elapsed)
+	}
+}
+
+func TestRunExitCodes(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	missing := filepath.Join(t.TempDir(), "no-such-dir", "out.json")
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		args       []string
+		want       int
+		wantStderr string
+	}{
+		{"success", context.Background(), []string{"seed", "-n", "2"}, ExitOK, ""},
+		{"unknown command", context.Background(), []string{"bogus"}, ExitUsage, `demo: usage: unknown command "bogus"`},
+		{"unknown flag", context.Background(), []string{"seed", "-nope"}, ExitUsage, "demo: usage:"},
+		{"bad flag value", context.Background(), []string{"seed", "-n", "-3"}, ExitUsage, "-n must not be negative"},
+		{"extra argument", context.Background(), []string{"demo", "extra"}, ExitUsage, `unexpected argument "extra"`},
+		{"bad version format", context.Background(), []string{"version", "-format", "xml"}, ExitUsage, `unknown format "xml"`},
+		{"runtime failure", context.Background(), []string{"seed", "-o", missing}, ExitRuntime, "demo: open"},
+		{"interrupted", cancelled, []string{"demo", "-deterministic"}, ExitRuntime, "demo: interrupted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if got := run(tt.ctx, tt.args, &stdout, &stderr); got != tt.want {
+				t.Errorf("run(%q) = %d, want %d; stderr:\n%s", tt.args, got, tt.want, stderr.String())
+			}
+			if tt.wantStderr == "" && stderr.Len() > 0 {
+				t.Errorf("unexpected stderr:\n%s", stderr.String())
+			}
+			if !strings.Contains(stderr.String(), tt.wantStderr) {
+				t.Errorf("stderr %q does not contain %q", stderr.String(), tt.wantStderr)
+			}
+		})
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	partial := &BatchError{Total: 3, Errors: []error{errors.New("row 2 bad")}}
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, ExitOK},
+		{errors.New("boom"), ExitRuntime},
+		{&UsageError{Msg: "bad flag"}, ExitUsage},
+		{fmt.Errorf("parsing: %w", &UsageError{Msg: "bad flag"}), ExitUsage},
+		{partial, ExitPartial},
+		{fmt.Errorf("import: %w", partial), ExitPartial},
+		{context.Canceled, ExitRuntime},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestInterleave(t *testing.T) {
+	tests := []struct {
+		name string
+		in   [][]int
+		want []int
+	}{
+		{"uneven", [][]int{{1, 2, 3}, {10, 20}}, []int{1, 10, 2, 20, 3}},
+		{"three inputs", [][]int{{1, 4}, {2}, {3, 5, 6}}, []int{1, 2, 3, 4, 5, 6}},
+		{"one empty", [][]int{nil, {7, 8}}, []int{7, 8}},
+		{"no inputs", nil, []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Interleave(tt.in...); !slices.Equal(got, tt.want) {
+				t.Errorf("Interleave(%v) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateEmail(t *testing.T) {
+	tests := []struct {
+		email   string
+		wantErr string
+	}{
+		{"alice@example.com", ""},
+		{"a@b", ""},
+		{"", "is empty"},
+		{"alice.example.com", "missing @"},
+		{"@example.com", "empty local part"},
+		{"alice@", "empty domain"},
+		{"@", "empty local part"},
+		{"alice@@example.com", "more than one @"},
+		{"alice@example@com", "more than one @"},
+	}
+	for _, tt := range tests {
+		err := ValidateEmail(tt.email)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("ValidateEmail(%q) = %v, want nil", tt.email, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("ValidateEmail(%q) = %v, want error containing %q", tt.email, err, tt.wantErr)
+		}
+
+		var p Person
+		if setErr := p.SetEmail(tt.email); (setErr == nil) != (err == nil) {
+			t.Errorf("SetEmail(%q) = %v, disagrees with ValidateEmail", tt.email, setErr)
+		}
+	}
+}
+
+func TestTapObservesEveryElement(t *testing.T) {
+	items := []string{"a", "b", "c", "d"}
+	var seen []string
+	out := Tap(items, func(s string) { seen = append(seen, s) })
+
+	if len(seen) != len(items) {
+		t.Errorf("observed %d elements, want %d", len(seen), len(items))
+	}
+	if !slices.Equal(seen, items) {
+		t.Errorf("observed %v, want %v in order", seen, items)
+	}
+	if &out[0] != &items[0] {
+		t.Error("Tap copied its input instead of returning it")
+	}
+	if got := Tap([]int(nil), func(int) { t.Error("observer called for empty input") }); got != nil {
+		t.Errorf("Tap(nil) = %v, want nil", got)
+	}
+}
+
+func TestCopyWithLeavesOriginalUnchanged(t *testing.T) {
+	email := "alice@example.com"
+	orig := Person{
+		ID:       1,
+		Name:     "Alice",
+		Age:      30,
+		Email:    &email,
+		Tags:     []string{"golang"},
+		Metadata: map[string]interface{}{"team": map[string]interface{}{"name": "core"}, "langs": []interface{}{"go"}},
+	}
+	before := orig.Clone()
+
+	updated := orig.CopyWith(func(p *Person) {
+		p.Age = 31
+		*p.Email = "alice@new.example.com"
+		p.Tags[0] = "rust"
+		p.Metadata["team"].(map[string]interface{})["name"] = "platform"
+		p.Metadata["langs"].([]interface{})[0] = "rust"
+	})
+
+	if updated.Age != 31 {
+		t.Errorf("updated.Age = %d, want 31", updated.Age)
+	}
+	if !reflect.DeepEqual(orig, before) {
+		t.Errorf("original changed by CopyWith:\n got %+v\nwant %+v", orig, before)
+	}
+	if email != "alice@example.com" {
+		t.Errorf("original email string changed to %q", email)
+	}
+}
+
+func TestCodedError(t *testing.T) {
+	cause := errors.New("disk full")
+	tests := []struct {
+		name     string
+		err      error
+		code     string
+		sentinel error
+		msg      string
+	}{
+		{"not found sentinel", fmt.Errorf("lookup 7: %w", ErrNotFound), CodeNotFound, ErrNotFound, "lookup 7: item not found"},
+		{"invalid with cause", NewInvalid("bad payload", cause), CodeInvalid, cause, "bad payload: disk full"},
+		{"conflict wrapped twice", fmt.Errorf("save: %w", fmt.Errorf("insert: %w", NewConflict("duplicate id", ErrDivisionByZero))), CodeConflict, ErrDivisionByZero, "save: insert: duplicate id: division by zero"},
+		{"joined", errors.Join(errors.New("other"), NewNotFound("no such user", nil)), CodeNotFound, nil, "other\nno such user"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ce *CodedError
+			if !errors.As(tt.err, &ce) {
+				t.Fatalf("errors.As found no CodedError in %v", tt.err)
+			}
+			if ce.Code != tt.code {
+				t.Errorf("code = %q, want %q", ce.Code, tt.code)
+			}
+			if tt.sentinel != nil && !errors.Is(tt.err, tt.sentinel) {
+				t.Errorf("errors.Is(%v, %v) = false", tt.err, tt.sentinel)
+			}
+			if got := tt.err.Error(); got != tt.msg {
+				t.Errorf("Error() = %q, want %q", got, tt.msg)
+			}
+		})
+	}
+
+	if errors.Is(NewNotFound("item not found", nil), ErrNotFound) {
+		t.Error("a fresh CodedError matched the ErrNotFound sentinel; Is should compare identity")
+	}
+}
+
+func TestInsert(t *testing.T) {
+	tests := []struct {
+		name  string
+		s     []int
+		index int
+		vals  []int
+		want  []int
+	}{
+		{"head", []int{2, 3}, 0, []int{1}, []int{1, 2, 3}},
+		{"middle", []int{1, 4}, 1, []int{2, 3}, []int{1, 2, 3, 4}},
+		{"tail", []int{1, 2}, 2, []int{3}, []int{1, 2, 3}},
+		{"into empty", nil, 0, []int{1}, []int{1}},
+		{"nothing", []int{1}, 1, nil, []int{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig := slices.Clone(tt.s)
+			got, err := Insert(tt.s, tt.index, tt.vals...)
+			if err != nil {
+				t.Fatalf("Insert: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Insert(%v, %d, %v) = %v, want %v", tt.s, tt.index, tt.vals, got, tt.want)
+			}
+			if !slices.Equal(tt.s, orig) {
+				t.Errorf("input changed to %v", tt.s)
+			}
+		})
+	}
+
+	for _, index := range []int{-1, 3} {
+		if _, err := Insert([]int{1, 2}, index, 9); err == nil {
+			t.Errorf("Insert at %d into a 2-element slice: expected an error", index)
+		}
+	}
+}
+
+func TestRemoveAt(t *testing.T) {
+	s := make([]int, 3, 10)
+	copy(s, []int{1, 2, 3})
+	for index, want := range [][]int{{2, 3}, {1, 3}, {1, 2}} {
+		got, err := RemoveAt(s, index)
+		if err != nil {
+			t.Fatalf("RemoveAt(%d): %v", index, err)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("RemoveAt(%v, %d) = %v, want %v", s, index, got, want)
+		}
+		_ = append(got, 99)
+		if !slices.Equal(s, []int{1, 2, 3}) || s[:4][3] == 99 {
+			t.Fatalf("result of RemoveAt(%d) aliases the input: %v", index, s[:4])
+		}
+	}
+
+	for _, tt := range []struct {
+		s     []int
+		index int
+	}{{nil, 0}, {[]int{1}, 1}, {[]int{1, 2}, -1}, {[]int{1, 2}, 5}} {
+		if got, err := RemoveAt(tt.s, tt.index); err == nil {
+			t.Errorf("RemoveAt(%v, %d) = %v, expected an out-of-range error", tt.s, tt.index, got)
+		}
+	}
+}
+
+func TestStrictDecodePerson(t *testing.T) {
+	clean := `{"id":1,"name":"Alice","age":30,"status":"active"}`
+	p, err := StrictDecodePerson([]byte(clean))
+	if err != nil {
+		t.Fatalf("clean payload: %v", err)
+	}
+	if p.Name != "Alice" || p.Age != 30 {
+		t.Errorf("decoded %+v", p)
+	}
+
+	_, err = StrictDecodePerson([]byte(`{"id":1,"name":"Alice","age":30,"status":"active","role":"admin"}`))
+	var fe *FieldError
+	if !errors.As(err, &fe) || fe.Field != "role" {
+		t.Fatalf("extra role field: error = %v, want a FieldError naming role", err)
+	}
+	if !strings.Contains(err.Error(), `"role"`) {
+		t.Errorf("error %q does not name the field", err)
+	}
+
+	if _, err := DecodePerson([]byte(`{"id":1,"name":"Alice","age":30,"status":"active","role":"admin"}`), DecodeOptions{}); err != nil {
+		t.Errorf("lenient decode rejected an unknown field: %v", err)
+	}
+	if _, err := StrictDecodePerson([]byte(clean + `{}`)); err == nil {
+		t.Error("trailing data accepted")
+	}
+}
+
+func TestVersionGolden(t *testing.T) {
+	for _, format := range []string{"text", "json"} {
+		t.Run(format, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := run(context.Background(), []string{"version", "-format", format}, &stdout, &stderr); code != ExitOK {
+				t.Fatalf("exit code %d, stderr:\n%s", code, stderr.String())
+			}
+			// Test binaries carry no VCS stamp; only the toolchain varies
+			got := bytes.ReplaceAll(stdout.Bytes(), []byte(runtime.Version()), []byte("GOVERSION"))
+			golden(t, "version."+format+".golden", got)
+		})
+	}
+}
+
+func TestVersionJSONIsParseable(t *testing.T) {
+	var stdout bytes.Buffer
+	if code := run(context.Background(), []string{"version", "-format=json"}, &stdout, io.Discard); code != ExitOK {
+		t.Fatalf("exit code %d", code)
+	}
+	var info BuildInfo
+	if err := json.Unmarshal(stdout.Bytes(), &info); err != nil {
+		t.Fatalf("version JSON: %v", err)
+	}
+	if info != readBuildInfo() {
+		t.Errorf("decoded %+v, want %+v", info, readBuildInfo())
+	}
+}
+
+func TestMemoizeRunsOncePerArgument(t *testing.T) {
+	var mu sync.Mutex
+	calls := make(map[int]int)
+	square := Memoize(func(n int) int {
+		mu.Lock()
+		calls[n]++
+		mu.Unlock()
+		time.Sleep(time.Millisecond) // widen the window for duplicate work
+		return n * n
+	})
+
+	const distinct, callers = 5, 20
+	var wg sync.WaitGroup
+	for range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range distinct {
+				if got := square(n); got != n*n {
+					t.Errorf("square(%d) = %d", n, got)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(calls) != distinct {
+		t.Errorf("fn saw %d distinct arguments, want %d", len(calls), distinct)
+	}
+	for n, c := range calls {
+		if c != 1 {
+			t.Errorf("fn(%d) ran %d times, want once", n, c)
+		}
+	}
+}
+
+func TestEnvRoundTrip(t *testing.T) {
+	email := "alice@example.com"
+	people := []Person{
+		{
+			ID:          42,
+			Name:        "Alice Müller",
+			Age:         30,
+			BirthDate:   time.Date(1994, time.May, 2, 0, 0, 0, 0, time.UTC),
+			Email:       &email,
+			Status:      StatusActive,
+			Created:     time.Date(2024, time.January, 1, 9, 30, 0, 123456789, time.UTC),
+			Tags:        []string{"developer", "golang"},
+			Metadata:    map[string]interface{}{"level": "senior", "skills": []interface{}{"go", "sql"}, "years": 7.0},
+			Permissions: PermRead | PermAdmin,
+		},
+		{ID: 7, Name: "Bob", Status: StatusPending},
+		{ID: 8, Name: "Cy", Tags: []string{"a,b", "c"}},
+		{ID: 9, Name: "Di", Tags: []string{}, Metadata: map[string]interface{}{}},
+		{ID: 10, Name: "Ed", Tags: []string{"", `"quoted"`, `a\b`, "x,"}},
+		{ID: 11, Name: "Fay", Tags: []string{""}},
+	}
+	for _, want := range people {
+		env, err := want.ToEnv("APP_USER")
+		if err != nil {
+			t.Fatalf("ToEnv(%s): %v", want.Name, err)
+		}
+		got, err := PersonFromEnv("APP_USER", env)
+		if err != nil {
+			t.Fatalf("PersonFromEnv(%v): %v", env, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("round trip of %s:\n got %+v\nwant %+v", want.Name, got, want)
+		}
+	}
+
+	if env, _ := (Person{Tags: []string{"a,b", "c"}}).ToEnv("X"); env["X_TAGS"] != `"a,b",c` {
+		t.Errorf("X_TAGS = %q, want %q", env["X_TAGS"], `"a,b",c`)
+	}
+	if _, err := (Person{Metadata: map[string]interface{}{"f": func() {}}}).ToEnv("X"); err == nil {
+		t.Error("ToEnv accepted metadata with no JSON form")
+	}
+
+	for _, bad := range []map[string]string{
+		{"X_AGE": "thirty"},
+		{"X_TAGS": `"a"b`},
+		{"X_TAGS": `"unterminated`},
+		{"X_METADATA": "not json"},
+	} {
+		_, err := PersonFromEnv("X", bad)
+		var ce *CodedError
+		for key := range bad {
+			if !errors.As(err, &ce) || ce.Code != CodeInvalid || ce.Message != key {
+				t.Errorf("%v: error = %v, want invalid %s", bad, err, key)
+			}
+		}
+	}
+}
+
+func TestGeneratedDataIsDeterministic(t *testing.T) {
+	hash := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+
+	// Pinned so an accidental change to the generator shows up as a diff
+	const seed1 = "eefe2d623a36e4ff2e69ce9a9d7b9e09f91768a98c86714f8c8ec822bf38bf73"
+	var stdout bytes.Buffer
+	if code := run(context.Background(), []string{"seed", "-n", "50", "-seed", "1"}, &stdout, io.Discard); code != ExitOK {
+		t.Fatalf("seed exit code %d", code)
+	}
+	sum := sha256.Sum256(stdout.Bytes())
+	if got := hex.EncodeToString(sum[:]); got != seed1 {
+		t.Errorf("seed 1 output hash = %s, want %s", got, seed1)
+	}
+
+	if hash(GeneratePeople(7, 200)) != hash(GeneratePeople(7, 200)) {
+		t.Error("GeneratePeople differs between runs with the same seed")
+	}
+	if hash(GenerateEmployees(7, 200)) != hash(GenerateEmployees(7, 200)) {
+		t.Error("GenerateEmployees differs between runs with the same seed")
+	}
+	if hash(GeneratePeople(7, 200)) == hash(GeneratePeople(8, 200)) {
+		t.Error("different seeds produced identical people")
+	}
+
+	for _, p := range GeneratePeople(3, 500) {
+		if err := p.Validate(); err != nil {
+			t.Fatalf("generated person %d is invalid: %v", p.ID, err)
+		}
+	}
+}
+
+func TestClampAndInRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       int
+		want    int
+		inRange bool
+	}{
+		{"below", -5, 0, false},
+		{"at low edge", 0, 0, true},
+		{"within", 42, 42, true},
+		{"at high edge", 150, 150, true},
+		{"above", 200, 150, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Clamp(tt.v, 0, 150); got != tt.want {
+				t.Errorf("Clamp(%d, 0, 150) = %d, want %d", tt.v, got, tt.want)
+			}
+			if got := InRange(tt.v, 0, 150); got != tt.inRange {
+				t.Errorf("InRange(%d, 0, 150) = %v, want %v", tt.v, got, tt.inRange)
+			}
+		})
+	}
+
+	if got := Clamp(1.5, 0.0, 1.0); got != 1.0 {
+		t.Errorf("Clamp(1.5, 0, 1) = %v, want 1", got)
+	}
+	if got := Clamp("m", "a", "k"); got != "k" {
+		t.Errorf(`Clamp("m", "a", "k") = %q, want "k"`, got)
+	}
+}
+
+// JSON array of n copies of one record, produced lazily so the input
+// itself never sits in memory
+type repeatedArray struct {
+	record []byte
+	left   int
+	buf    bytes.Buffer
+	opened bool
+}
+
+func (r *repeatedArray) Read(p []byte) (int, error) {
+	for r.buf.Len() < len(p) && (r.left > 0 || !r.opened) {
+		switch {
+		case !r.opened:
+			r.buf.WriteByte('[')
+			r.opened = true
+		default:
+			r.buf.Write(r.record)
+			if r.left--; r.left > 0 {
+				r.buf.WriteByte(',')
+			} else {
+				r.buf.WriteByte(']')
+			}
+		}
+	}
+	if r.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return r.buf.Read(p)
+}
+
+func BenchmarkDecodePeopleStream(b *testing.B) {
+	record, err := json.Marshal(GeneratePeople(1, 1)[0])
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, n := range []int{1_000, 10_000, 100_000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			b.ReportAllocs()
+			var peak uint64
+			var ms runtime.MemStats
+			for b.Loop() {
+				count := 0
+				err := DecodePeopleStream(&repeatedArray{record: record, left: n}, DecodeOptions{}, func(Person) error {
+					if count++; count%1000 == 0 {
+						runtime.ReadMemStats(&ms)
+						peak = max(peak, ms.HeapAlloc)
+					}
+					return nil
+				})
+				if err != nil || count != n {
+					b.Fatalf("decoded %d of %d records: %v", count, n, err)
+				}
+			}
+			// Flat memory: the peak live heap stays the same as n grows
+			b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+		})
+	}
+}
+
+func TestDecodePeopleStreamStopsOnCallbackError(t *testing.T) {
+	record, _ := json.Marshal(GeneratePeople(1, 1)[0])
+	stop := errors.New("stop")
+	seen := 0
+	err := DecodePeopleStream(&repeatedArray{record: record, left: 10}, DecodeOptions{}, func(Person) error {
+		if seen++; seen == 3 {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) || !strings.Contains(err.Error(), "element 2") {
+		t.Errorf("error = %v, want stop wrapped with element 2", err)
+	}
+	if seen != 3 {
+		t.Errorf("callback ran %d times after returning an error at 3", seen)
+	}
+}
+
+func TestRunningStatsMatchesBatch(t *testing.T) {
+	batch := func(xs []float64) (mean, variance float64) {
+		for _, x := range xs {
+			mean += x
+		}
+		mean /= float64(len(xs))
+		for _, x := range xs {
+			variance += (x - mean) * (x - mean)
+		}
+		return mean, variance / float64(len(xs))
+	}
+
+	var ages []float64
+	for _, p := range GeneratePeople(11, 1000) {
+		ages = append(ages, float64(p.Age))
+	}
+	inputs := map[string][]float64{
+		"generated ages": ages,
+		"single":         {42},
+		"constant":       {30, 30, 30},
+		// a large offset defeats the naive sum-of-squares formula
+		"large offset": {1e9 + 4, 1e9 + 7, 1e9 + 13, 1e9 + 16},
+	}
+	for name, xs := range inputs {
+		t.Run(name, func(t *testing.T) {
+			var s RunningStats
+			for _, x := range xs {
+				s.Add(x)
+			}
+			mean, variance := batch(xs)
+			if s.Count() != len(xs) {
+				t.Errorf("Count() = %d, want %d", s.Count(), len(xs))
+			}
+			if math.Abs(s.Mean()-mean) > 1e-9*math.Max(1, math.Abs(mean)) {
+				t.Errorf("Mean() = %v, batch mean %v", s.Mean(), mean)
+			}
+			if math.Abs(s.Variance()-variance) > 1e-6*math.Max(1, variance) {
+				t.Errorf("Variance() = %v, batch variance %v", s.Variance(), variance)
+			}
+		})
+	}
+
+	var empty RunningStats
+	if empty.Mean() != 0 || empty.Variance() != 0 {
+		t.Errorf("empty stats: mean %v variance %v, want 0", empty.Mean(), empty.Variance())
+	}
+}
+
+func TestNDJSONCorruptMiddleLine(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "corrupt_middle.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("strict", func(t *testing.T) {
+		var names []string
+		var lastErr error
+		for p, err := range DecodeNDJSON(bytes.NewReader(data), DecodeOptions{Strict: true}) {
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			names = append(names, p.Name)
+		}
+		if !slices.Equal(names, []string{"Alice", "Bob"}) {
+			t.Errorf("decoded %v before the error, want [Alice Bob]", names)
+		}
+		if lastErr == nil || !strings.HasPrefix(lastErr.Error(), "line 4: ") {
+			t.Errorf("error = %v, want one reported on line 4", lastErr)
+		}
+	})
+
+	t.Run("lenient", func(t *testing.T) {
+		var names []string
+		skipped := 0
+		for p, err := range DecodeNDJSONSkipInvalid(bytes.NewReader(data), DecodeOptions{Strict: true}, &skipped) {
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			names = append(names, p.Name)
+		}
+		if !slices.Equal(names, []string{"Alice", "Bob", "Dana"}) {
+			t.Errorf("decoded %v, want [Alice Bob Dana]", names)
+		}
+		if skipped != 1 {
+			t.Errorf("skipped = %d, want 1", skipped)
+		}
+	})
+}
+
+func TestNDJSONRoundTrip(t *testing.T) {
+	people := GeneratePeople(5, 20)
+	var buf bytes.Buffer
+	if err := EncodeNDJSON(&buf, slices.Values(people)); err != nil {
+		t.Fatalf("EncodeNDJSON: %v", err)
+	}
+	if n := bytes.Count(buf.Bytes(), []byte("\n")); n != len(people) {
+		t.Errorf("wrote %d lines, want %d", n, len(people))
+	}
+	var got []Person
+	for p, err := range DecodeNDJSON(&buf, DecodeOptions{Strict: true}) {
+		if err != nil {
+			t.Fatalf("DecodeNDJSON: %v", err)
+		}
+		got = append(got, p)
+	}
+	if len(got) != len(people) {
+		t.Fatalf("decoded %d people, want %d", len(got), len(people))
+	}
+	for i := range people {
+		if !got[i].Created.Equal(people[i].Created) || got[i].Name != people[i].Name || got[i].ID != people[i].ID {
+			t.Errorf("record %d: got %+v, want %+v", i, got[i], people[i])
+		}
+	}
+}
+
+func TestSortedInsert(t *testing.T) {
+	less := func(a, b int) bool { return a < b }
+	tests := []struct {
+		name string
+		s    []int
+		v    int
+		want []int
+	}{
+		{"empty", nil, 5, []int{5}},
+		{"front", []int{2, 4, 6}, 1, []int{1, 2, 4, 6}},
+		{"middle", []int{2, 4, 6}, 5, []int{2, 4, 5, 6}},
+		{"end", []int{2, 4, 6}, 9, []int{2, 4, 6, 9}},
+		{"duplicate", []int{2, 4, 6}, 4, []int{2, 4, 4, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SortedInsert(slices.Clone(tt.s), tt.v, less); !slices.Equal(got, tt.want) {
+				t.Errorf("SortedInsert(%v, %d) = %v, want %v", tt.s, tt.v, got, tt.want)
+			}
+		})
+	}
+
+	// Equal elements keep insertion order: v lands after existing equals
+	type item struct {
+		key   int
+		label string
+	}
+	byKey := func(a, b item) bool { return a.key < b.key }
+	var items []item
+	for _, it := range []item{{2, "a"}, {1, "b"}, {2, "c"}, {1, "d"}} {
+		items = SortedInsert(items, it, byKey)
+	}
+	want := []item{{1, "b"}, {1, "d"}, {2, "a"}, {2, "c"}}
+	if !slices.Equal(items, want) {
+		t.Errorf("stable inserts = %v, want %v", items, want)
+	}
+}
+
+func xmlFixture() Employee {
+	email := "alice@example.com"
+	return Employee{
+		Person: Person{
+			ID:          1,
+			Name:        "Alice & Co <HQ>",
+			Age:         30,
+			BirthDate:   time.Date(1994, time.May, 2, 0, 0, 0, 0, time.UTC),
+			Email:       &email,
+			Status:      StatusActive,
+			Created:     time.Date(2024, time.January, 1, 9, 0, 0, 0, time.UTC),
+			Tags:        []string{"developer", "golang"},
+			Metadata:    map[string]interface{}{"level": "senior", "department": "engineering"},
+			Permissions: PermRead | PermWrite,
+		},
+		Department: "Engineering",
+		Salary:     85000.5,
+	}
+}
+
+func TestXMLRoundTrip(t *testing.T) {
+	want := xmlFixture()
+	data, err := xml.Marshal(want)
+	if err != nil {
+		t.Fatalf("marshal employee: %v", err)
+	}
+	var got Employee
+	if err := xml.Unmarshal(data, &got); err != nil {
+		t.Fatalf("unmarshal employee: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("employee round trip:\n got %+v\nwant %+v", got, want)
+	}
+
+	var p Person
+	if err := xml.Unmarshal([]byte(`<person id="2"><name>Bob</name><age>25</age><status>retired</status></person>`), &p); err == nil {
+		t.Error("invalid status accepted")
+	}
+}
+
+func TestXMLGolden(t *testing.T) {
+	data, err := xml.MarshalIndent(xmlFixture(), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "employee.xml", append(data, '\n'))
+
+	// The fixture decodes on its own, as a partner payload would
+	fixture, err := os.ReadFile(filepath.Join("testdata", "employee.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Employee
+	if err := xml.Unmarshal(fixture, &got); err != nil {
+		t.Fatalf("decode fixture: %v", err)
+	}
+	if want := xmlFixture(); !reflect.DeepEqual(got, want) {
+		t.Errorf("fixture decoded to %+v, want %+v", got, want)
+	}
+}
+
+func TestOrderedResults(t *testing.T) {
+	const n = 8
+	submit, results := OrderedResults[string](n)
+
+	// Workers finish in reverse order of submission index
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Duration(n-i) * time.Millisecond)
+			submit(i, strconv.Itoa(i*i))
+		}()
+	}
+	got := results()
+	wg.Wait()
+
+	want := []string{"0", "1", "4", "9", "16", "25", "36", "49"}
+	if !slices.Equal(got, want) {
+		t.Errorf("results() = %v, want %v", got, want)
+	}
+
+	_, empty := OrderedResults[int](0)
+	if got := empty(); len(got) != 0 {
+		t.Errorf("empty results = %v", got)
+	}
+}
+
+func TestOrderedResultsPanicsOnMisuse(t *testing.T) {
+	mustPanic := func(name string, f func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s did not panic", name)
+			}
+		}()
+		f()
+	}
+	submit, _ := OrderedResults[int](2)
+	mustPanic("index out of range", func() { submit(2, 0) })
+	mustPanic("negative index", func() { submit(-1, 0) })
+	submit(0, 1)
+	mustPanic("duplicate index", func() { submit(0, 1) })
+}
+
+func TestBatchRoundTrip(t *testing.T) {
+	people := GeneratePeople(9, 25)
+	people[0].BirthDate = time.Date(1990, time.February, 28, 0, 0, 0, 0, time.UTC)
+	people[1].Permissions = PermAll
+	var buf bytes.Buffer
+	if err := EncodeBatch(&buf, people); err != nil {
+		t.Fatalf("EncodeBatch: %v", err)
+	}
+	encoded := bytes.Clone(buf.Bytes())
+	got, err := DecodeBatch(&buf)
+	if err != nil {
+		t.Fatalf("DecodeBatch: %v", err)
+	}
+	if len(got) != len(people) {
+		t.Fatalf("decoded %d people, want %d", len(got), len(people))
+	}
+	for i := range people {
+		a, _ := people[i].MarshalCanonical()
+		b, _ := got[i].MarshalCanonical()
+		if !bytes.Equal(a, b) {
+			t.Errorf("record %d:\n got %s\nwant %s", i, b, a)
+		}
+	}
+
+	// Any single flipped byte must be caught, never decoded silently
+	for i := range encoded {
+		corrupt := bytes.Clone(encoded)
+		corrupt[i] ^= 0x20
+		if got, err := DecodeBatch(bytes.NewReader(corrupt)); err == nil && len(got) == len(people) {
+			t.Fatalf("flipping byte %d went undetected", i)
+		}
+	}
+}
+
+func FuzzDecodeBatch(f *testing.F) {
+	var buf bytes.Buffer
+	if err := EncodeBatch(&buf, GeneratePeople(2, 3)); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buf.Bytes())
+	f.Add([]byte{})
+	f.Add([]byte{0xff, 0xff, 0xff, 0x07}) // length prefix near the record limit
+	f.Add(binary.AppendUvarint(nil, maxBinaryRecord+1))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		people, err := DecodeBatch(bytes.NewReader(data))
+		runtime.ReadMemStats(&after)
+
+		// Allocation tracks the input size, never a forged length prefix
+		if grown := after.TotalAlloc - before.TotalAlloc; grown > 1<<20+64*uint64(len(data)) {
+			t.Fatalf("decoding %d bytes allocated %d bytes", len(data), grown)
+		}
+		if err != nil {
+			return
+		}
+		var again bytes.Buffer
+		if err := EncodeBatch(&again, people); err != nil {
+			t.Fatalf("re-encoding decoded people: %v", err)
+		}
+	})
+}
+
+func FuzzUnmarshalBinary(f *testing.F) {
+	seeds := append(GeneratePeople(3, 7), xmlFixture().Person, Person{})
+	for _, p := range seeds {
+		data, err := p.MarshalBinary()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+		f.Add(data[:len(data)/2])
+	}
+	f.Add([]byte{})
+	f.Add([]byte{binaryVersion, 0xff, 0xff, 0xff, 0xff, 0x0f}) // forged field length
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		var p Person
+		err := p.UnmarshalBinary(data)
+		runtime.ReadMemStats(&after)
+
+		if grown := after.TotalAlloc - before.TotalAlloc; grown > 1<<20+64*uint64(len(data)) {
+			t.Fatalf("decoding %d bytes allocated %d bytes", len(data), grown)
+		}
+		if err != nil {
+			return
+		}
+		// One encode/decode cycle canonicalizes; a second must not change it
+		first, err := p.MarshalBinary()
+		if err != nil {
+			t.Fatalf("re-encoding decoded person: %v", err)
+		}
+		var q Person
+		if err := q.UnmarshalBinary(first); err != nil {
+			t.Fatalf("decoding re-encoded person: %v", err)
+		}
+		second, err := q.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(first, second) {
+			t.Fatalf("encoding not stable:\n%x\n%x", first, second)
+		}
+	})
+}
+
+func TestBuildRoster(t *testing.T) {
+	emp := func(name, dept string) Employee {
+		return Employee{Person: Person{Name: name}, Department: dept}
+	}
+	roster := BuildRoster([]Employee{
+		emp("Zoe", "Engineering"),
+		emp("Bob", "Sales"),
+		emp("Alice", "Engineering"),
+		emp("Carl", ""),
+		emp("Mia", "Engineering"),
+	})
+
+	names := make(map[string][]string)
+	for dept, group := range roster {
+		for _, e := range group {
+			names[dept] = append(names[dept], e.Name)
+		}
+	}
+	want := map[string][]string{
+		"Engineering":  {"Alice", "Mia", "Zoe"},
+		"Sales":        {"Bob"},
+		"(unassigned)": {"Carl"},
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("roster = %v, want %v", names, want)
+	}
+	if got := roster.HeadCount(); !maps.Equal(got, map[string]int{"Engineering": 3, "Sales": 1, "(unassigned)": 1}) {
+		t.Errorf("HeadCount() = %v", got)
+	}
+	if got := BuildRoster(nil).HeadCount(); len(got) != 0 {
+		t.Errorf("empty roster head count = %v", got)
+	}
+}
+
+func TestStrictDecodingAndNestedMetadata(t *testing.T) {
+	strict := DecodeOptions{Strict: true}
+
+	// Metadata is free-form: nested keys are never "unknown", even strictly
+	nested := `{"id":1,"name":"Ann","age":30,"status":"active","metadata":{"emial":"x","team":{"naem":"core","extra":{"deep":[1,{"k":true}]}}}}`
+	p, err := DecodePerson([]byte(nested), strict)
+	if err != nil {
+		t.Fatalf("strict decode with nested metadata keys: %v", err)
+	}
+	team, _ := p.Metadata["team"].(map[string]interface{})
+	if team["naem"] != "core" || p.Metadata["emial"] != "x" {
+		t.Errorf("nested metadata not preserved: %v", p.Metadata)
+	}
+
+	tests := []struct {
+		name   string
+		input  string
+		field  string
+		prefix string
+	}{
+		{"single object", `{"id":1,"name":"Ann","age":30,"status":"active","emial":"a@b"}`, "emial", "line 1: "},
+		{"array element", `[{"id":1,"name":"Ann","age":30,"status":"active"},{"id":2,"name":"Bo","age":3,"status":"active","metdata":{}}]`, "metdata", "element 1: "},
+		{"ndjson line", "{\"id\":1,\"name\":\"Ann\",\"age\":30,\"status\":\"active\"}\n\n{\"id\":2,\"name\":\"Bo\",\"age\":3,\"status\":\"active\",\"tag\":[]}\n", "tag", "line 3: "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := DecodePeopleStream(strings.NewReader(tt.input), strict, func(Person) error { return nil })
+			var fe *FieldError
+			if !errors.As(err, &fe) || fe.Field != tt.field {
+				t.Fatalf("error = %v, want a FieldError naming %q", err, tt.field)
+			}
+			if !strings.HasPrefix(err.Error(), tt.prefix) {
+				t.Errorf("error %q does not start with %q", err, tt.prefix)
+			}
+			if err := DecodePeopleStream(strings.NewReader(tt.input), DecodeOptions{}, func(Person) error { return nil }); err != nil {
+				t.Errorf("lenient decode failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestRetryUntilActive(t *testing.T) {
+	statuses := []Status{StatusPending, StatusPending, StatusActive}
+	calls := 0
+	fetch := func() (Person, error) {
+		calls++
+		if calls == 1 {
+			return Person{}, errors.New("temporary failure")
+		}
+		return Person{ID: 1, Status: statuses[min(calls-1, len(statuses)-1)]}, nil
+	}
+	isActive := func(p Person) bool { return p.Status == StatusActive }
+
+	p, err := RetryUntil(5, fetch, isActive)
+	if err != nil {
+		t.Fatalf("RetryUntil: %v", err)
+	}
+	if p.Status != StatusActive || calls != 3 {
+		t.Errorf("got status %q after %d calls, want active after 3", p.Status, calls)
+	}
+
+	calls = 0
+	p, err = RetryUntil(2, fetch, isActive)
+	if err == nil || !strings.Contains(err.Error(), "not accepted after 2 attempts") {
+		t.Errorf("exhausted retries: error = %v", err)
+	}
+	if p.Status != StatusPending {
+		t.Errorf("exhausted retries returned status %q, want the last result", p.Status)
+	}
+
+	calls = 0
+	failing := func() (Person, error) { calls++; return Person{}, ErrNotFound }
+	if _, err := RetryUntil(0, failing, isActive); !errors.Is(err, ErrNotFound) || calls != MaxRetries {
+		t.Errorf("default attempts: %d calls, error %v; want %d calls and the last error", calls, err, MaxRetries)
+	}
+}
+
+func TestJSONCasingGolden(t *testing.T) {
+	want := xmlFixture()
+	// Metadata keys belong to the caller and keep their casing both ways
+	want.Metadata["login_count"] = 42.0
+	want.Metadata["referredBy"] = map[string]interface{}{"userID": "u-7"}
+	for name, casing := range map[string]Casing{"snake": SnakeCase, "camel": CamelCase} {
+		t.Run(name, func(t *testing.T) {
+			data, err := EncodeJSONWithCasing(want, casing)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			var pretty bytes.Buffer
+			if err := json.Indent(&pretty, data, "", "  "); err != nil {
+				t.Fatal(err)
+			}
+			golden(t, "employee."+name+".json.golden", append(pretty.Bytes(), '\n'))
+
+			var got Employee
+			if err := DecodeJSONWithCasing(data, &got, casing); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("round trip:\n got %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestJSONCasingFollowsStructFields(t *testing.T) {
+	roster := map[string][]*Person{"night_shift": {{ID: 1, BirthDate: time.Date(1990, time.June, 1, 0, 0, 0, 0, time.UTC)}}}
+	data, err := EncodeJSONWithCasing(roster, CamelCase)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if !bytes.Contains(data, []byte(`{"night_shift":[{"id":1,"name":"","age":0,"birthDate":`)) {
+		t.Errorf("map key re-keyed or struct field missed: %s", data)
+	}
+	var got map[string][]*Person
+	if err := DecodeJSONWithCasing(data, &got, CamelCase); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !reflect.DeepEqual(got, roster) {
+		t.Errorf("round trip:\n got %s\nwant %+v", data, roster)
+	}
+}
+
+func TestPersonRawPreservesMetadataBytes(t *testing.T) {
+	// Unsorted keys, a big integer, trailing-zero decimals, exponents and
+	// escapes: everything a map[string]interface{} round trip would alter
+	metadata := `{"zeta":1,"alpha":{"b":2,"a":1},"id":12345678901234567890,"ratio":1.50,"tiny":1e-7,"name":"café","list":[3,1,2]}`
+	doc := `{"id":1,"name":"Ann","age":30,"status":"active","created":"2024-01-01T09:00:00Z","tags":null,"metadata":` + metadata + `}`
+
+	var raw PersonRaw
+	if err := json.Unmarshal([]byte(doc), &raw); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if string(raw.Metadata) != metadata {
+		t.Errorf("decoded metadata:\n got %s\nwant %s", raw.Metadata, metadata)
+	}
+	out, err := json.Marshal(raw)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if !bytes.Contains(out, []byte(`"metadata":`+metadata)) {
+		t.Errorf("re-encoded document lost metadata bytes:\n%s", out)
+	}
+
+	// The typed Person, by contrast, normalises the same metadata
+	var typed Person
+	if err := json.Unmarshal([]byte(doc), &typed); err != nil {
+		t.Fatal(err)
+	}
+	lossy, _ := json.Marshal(typed.Metadata)
+	if string(lossy) == metadata {
+		t.Error("expected the map-based round trip to alter metadata")
+	}
+
+	if err := json.Unmarshal([]byte(`{"id":1,"metadata":[1]}`), &raw); err == nil {
+		t.Error("non-object metadata accepted")
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	tests := []struct {
+		name      string
+		a, b      []int
+		want      []int
+		hasPrefix bool // HasPrefix(a, b)
+	}{
+		{"fully equal", []int{1, 2, 3}, []int{1, 2, 3}, []int{1, 2, 3}, true},
+		{"b is a prefix", []int{1, 2, 3}, []int{1, 2}, []int{1, 2}, true},
+		{"a is a prefix", []int{1, 2}, []int{1, 2, 3}, []int{1, 2}, false},
+		{"partial", []int{1, 2, 9}, []int{1, 2, 3}, []int{1, 2}, false},
+		{"disjoint", []int{4, 5}, []int{1, 2}, []int{}, false},
+		{"empty prefix", []int{1}, nil, []int{}, true},
+		{"both empty", nil, nil, []int{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CommonPrefix(tt.a, tt.b); !slices.Equal(got, tt.want) {
+				t.Errorf("CommonPrefix(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+			if got := HasPrefix(tt.a, tt.b); got != tt.hasPrefix {
+				t.Errorf("HasPrefix(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.hasPrefix)
+			}
+		})
+	}
+
+	a := []string{"x", "y"}
+	if p := CommonPrefix(a, []string{"x"}); &p[0] != &a[0] {
+		t.Error("CommonPrefix should return a subslice of a")
+	}
+}
+
+func TestEnvelopesDetectCorruptedBytes(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteEnveloped(&buf, slices.Values(GeneratePeople(4, 3))); err != nil {
+		t.Fatalf("WriteEnveloped: %v", err)
+	}
+	clean := buf.Bytes()
+	if report, err := VerifyEnveloped(bytes.NewReader(clean)); err != nil || !report.OK() || report.Records != 3 {
+		t.Fatalf("clean export: report %+v, err %v", report, err)
+	}
+
+	// Every byte but the final newline, which carries no data
+	for i := range len(clean) - 1 {
+		corrupt := bytes.Clone(clean)
+		corrupt[i] ^= 0x01
+		report, err := VerifyEnveloped(bytes.NewReader(corrupt))
+		if err != nil {
+			t.Fatalf("byte %d: %v", i, err)
+		}
+		if report.OK() {
+			t.Fatalf("flipping byte %d (%q) went undetected", i, clean[i])
+		}
+	}
+
+	// Truncation drops the trailer
+	lines := bytes.SplitAfter(clean, []byte("\n"))
+	truncated := bytes.Join(lines[:2], nil)
+	if report, _ := VerifyEnveloped(bytes.NewReader(truncated)); report.OK() || report.TrailerOK {
+		t.Errorf("truncated export passed verification: %+v", report)
+	}
+
+	// The NDJSON reader checks envelopes too
+	payloadAt := bytes.Index(clean, []byte(`"name":"`)) + len(`"name":"`)
+	corrupt := bytes.Clone(clean)
+	corrupt[payloadAt] ^= 0x01
+	for _, err := range DecodeNDJSON(bytes.NewReader(corrupt), DecodeOptions{}) {
+		if err != nil {
+			if !strings.Contains(err.Error(), "checksum mismatch") {
+				t.Errorf("error = %v, want a checksum mismatch", err)
+			}
+			return
+		}
+	}
+	t.Error("DecodeNDJSON accepted a corrupted envelope")
+}
+
+func TestSemaphore(t *testing.T) {
+	sem := NewSemaphore(2)
+	ctx := context.Background()
+	if err := sem.Acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !sem.TryAcquire() {
+		t.Fatal("second slot unavailable")
+	}
+	if sem.TryAcquire() {
+		t.Fatal("acquired a third slot from a semaphore of two")
+	}
+	sem.Release()
+	if !sem.TryAcquire() {
+		t.Fatal("released slot not reusable")
+	}
+	sem.Release()
+	sem.Release()
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Release without Acquire did not panic")
+		}
+	}()
+	sem.Release()
+}
+
+func TestSemaphoreBoundsConcurrency(t *testing.T) {
+	const limit = 3
+	sem := NewSemaphore(limit)
+	var active, peak atomic.Int32
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sem.Acquire(context.Background()); err != nil {
+				t.Error(err)
+				return
+			}
+			defer sem.Release()
+			n := active.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			active.Add(-1)
+		}()
+	}
+	wg.Wait()
+	if p := peak.Load(); p > limit {
+		t.Errorf("peak concurrency %d exceeds limit %d", p, limit)
+	}
+}
+
+func TestSemaphoreAcquireCancelled(t *testing.T) {
+	sem := NewSemaphore(1)
+	if !sem.TryAcquire() {
+		t.Fatal("fresh semaphore is full")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := sem.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("blocked Acquire = %v, want DeadlineExceeded", err)
+	}
+
+	// An already-cancelled context fails even when a slot is free
+	sem.Release()
+	cancelled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	if err := sem.Acquire(cancelled); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled Acquire = %v, want Canceled", err)
+	}
+	if !sem.TryAcquire() {
+		t.Error("failed Acquire still took the slot")
+	}
+}
+
+func TestNextBirthday(t *testing.T) {
+	date := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		name  string
+		birth time.Time
+		from  time.Time
+		want  time.Time
+	}{
+		{"later this year", date(1990, time.June, 15), date(2024, time.March, 1), date(2024, time.June, 15)},
+		{"today", date(1990, time.June, 15), time.Date(2024, time.June, 15, 18, 30, 0, 0, time.UTC), date(2024, time.June, 15)},
+		{"across year boundary", date(1990, time.January, 3), date(2024, time.December, 30), date(2025, time.January, 3)},
+		{"new year's eve from new year's day", date(1990, time.December, 31), date(2025, time.January, 1), date(2025, time.December, 31)},
+		{"feb 29 in a leap year", date(2000, time.February, 29), date(2024, time.January, 10), date(2024, time.February, 29)},
+		{"feb 29 in a common year", date(2000, time.February, 29), date(2025, time.January, 10), date(2025, time.March, 1)},
+		{"feb 29 just passed", date(2000, time.February, 29), date(2024, time.March, 1), date(2025, time.March, 1)},
+		{"feb 29 century rule", date(2000, time.February, 29), date(2100, time.January, 1), date(2100, time.March, 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Person{BirthDate: tt.birth}.NextBirthday(tt.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("NextBirthday(%s) = %s, want %s", tt.from.Format(time.DateOnly), got.Format(time.DateOnly), tt.want.Format(time.DateOnly))
+			}
+		})
+	}
+
+	if _, err := (Person{}).NextBirthday(date(2024, time.January, 1)); err == nil {
+		t.Error("missing birth date accepted")
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	var runs atomic.Int32
+	throttled := Throttle(time.Hour, func() { runs.Add(1) })
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				throttled()
+			}
+		}()
+	}
+	wg.Wait()
+	if got := runs.Load(); got != 1 {
+		t.Fatalf("fn ran %d times within one interval, want 1", got)
+	}
+
+	runs.Store(0)
+	clock := NewFakeClock(time.Time{})
+	throttled = throttle(clock, 20*time.Millisecond, func() { runs.Add(1) })
+	throttled()
+	clock.Advance(19 * time.Millisecond)
+	throttled()
+	if got := runs.Load(); got != 1 {
+		t.Errorf("fn ran %d times within one interval, want 1", got)
+	}
+	clock.Advance(time.Millisecond)
+	throttled()
+	throttled()
+	if got := runs.Load(); got != 2 {
+		t.Errorf("fn ran %d times across two intervals, want 2", got)
+	}
+}
+
+var propSeed = flag.Uint64("prop.seed", 0, "seed for property tests (0 picks one from the clock)")
+
+// Quick-check style driver: prop runs on n generated values and a failure
+// reports the seed and the offending value so it can be replayed with
+// -prop.seed
+func checkProperty[T any](t *testing.T, n int, gen func(*rand.Rand) T, prop func(T) error) {
+	t.Helper()
+	seed := *propSeed
+	if seed == 0 {
+		seed = uint64(time.Now().UnixNano())
+	}
+	r := rand.New(rand.NewPCG(seed, seed))
+	for i := range n {
+		v := gen(r)
+		if err := prop(v); err != nil {
+			repro, jerr := json.Marshal(v)
+			if jerr != nil {
+				repro = fmt.Appendf(nil, "%#v", v)
+			}
+			if len(repro) > 2048 {
+				repro = append(repro[:2048], "..."...)
+			}
+			t.Fatalf("case %d failed (-prop.seed=%d): %v\nvalue: %s", i, seed, err, repro)
+		}
+	}
+}
+
+var adversarialStrings = []string{
+	"",
+	" ",
+	"שלום עולם",
+	"e\u0301\u0301",
+	"\u202egnp.exe",
+	"日本語",
+	"😀👍🏽",
+	"nul\x00byte",
+	`"quoted" \ <tag> & 'single'`,
+	strings.Repeat("long", 4096),
+}
+
+var runeRanges = [][2]rune{{0x20, 0x7e}, {0xa0, 0x24f}, {0x590, 0x5ff}, {0x300, 0x36f}, {0x4e00, 0x9fff}, {0x1f600, 0x1f64f}}
+
+func genString(r *rand.Rand) string {
+	if r.IntN(2) == 0 {
+		return adversarialStrings[r.IntN(len(adversarialStrings))]
+	}
+	var b strings.Builder
+	for range r.IntN(32) {
+		rr := runeRanges[r.IntN(len(runeRanges))]
+		b.WriteRune(rr[0] + r.Int32N(rr[1]-rr[0]+1))
+	}
+	return b.String()
+}
+
+func genInt64(r *rand.Rand) int64 {
+	boundaries := []int64{0, 1, -1, math.MaxInt32, math.MinInt32, math.MaxInt64, math.MinInt64}
+	if r.IntN(3) == 0 {
+		return boundaries[r.IntN(len(boundaries))]
+	}
+	return r.Int64N(1000) - 500
+}
+
+// Times stay within the years encoding/json can marshal
+func genTime(r *rand.Rand) time.Time {
+	switch r.IntN(4) {
+	case 0:
+		return time.Time{}
+	case 1:
+		return time.Unix(0, 0).UTC()
+	default:
+		return time.Unix(r.Int64N(253402300799), r.Int64N(1e9)).UTC()
+	}
+}
+
+// JSON-shaped values only, so a round trip through interface{} is exact
+func genValue(r *rand.Rand, depth int) interface{} {
+	floats := []float64{0, -1.5, 1e21, math.MaxFloat64, math.SmallestNonzeroFloat64}
+	switch k := r.IntN(6); {
+	case k == 0:
+		return nil
+	case k == 1:
+		return r.IntN(2) == 0
+	case k == 2:
+		return floats[r.IntN(len(floats))]
+	case k == 3 && depth > 0:
+		// A typed nil map would come back from JSON as an untyped nil
+		if m := genMetadata(r, depth-1); m != nil {
+			return m
+		}
+		return map[string]interface{}{}
+	case k == 4 && depth > 0:
+		s := make([]interface{}, r.IntN(4))
+		for i := range s {
+			s[i] = genValue(r, depth-1)
+		}
+		return s
+	default:
+		return genString(r)
+	}
+}
+
+func genMetadata(r *rand.Rand, depth int) map[string]interface{} {
+	n := r.IntN(5)
+	switch r.IntN(8) {
+	case 0:
+		return nil
+	case 1:
+		n = 200
+	}
+	m := make(map[string]interface{}, n)
+	for range n {
+		m[genString(r)] = genValue(r, depth)
+	}
+	return m
+}
+
+func genPerson(r *rand.Rand) Person {
+	p := Person{
+		ID:          UserID(genInt64(r)),
+		Name:        genString(r),
+		Age:         int(genInt64(r)),
+		BirthDate:   genTime(r),
+		Status:      Status(genString(r)),
+		Created:     genTime(r),
+		Metadata:    genMetadata(r, 2),
+		Permissions: Permission(r.UintN(256)),
+	}
+	if r.IntN(2) == 0 {
+		email := genString(r)
+		p.Email = &email
+	}
+	if r.IntN(4) != 0 {
+		p.Tags = make([]string, r.IntN(4))
+		for i := range p.Tags {
+			p.Tags[i] = genString(r)
+		}
+	}
+	return p
+}
+
+func TestPropertyPersonJSONRoundTrip(t *testing.T) {
+	checkProperty(t, 200, genPerson, func(p Person) error {
+		data, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		var back Person
+		if err := json.Unmarshal(data, &back); err != nil {
+			return err
+		}
+		if field := firstDifferentField(back, p); field != "" {
+			return fmt.Errorf("round trip changed %s", field)
+		}
+		return nil
+	})
+}
+
+func firstDifferentField(a, b Person) string {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := range va.NumField() {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			return va.Type().Field(i).Name
+		}
+	}
+	return ""
+}
+
+func TestPropertyCloneIndependence(t *testing.T) {
+	checkProperty(t, 200, genPerson, func(p Person) error {
+		before, err := p.MarshalCanonical()
+		if err != nil {
+			return err
+		}
+		c := p.Clone()
+		if field := firstDifferentField(c, p); field != "" {
+			return fmt.Errorf("clone differs from the original in %s", field)
+		}
+		if c.Email != nil {
+			*c.Email += "x"
+		}
+		for i := range c.Tags {
+			c.Tags[i] += "x"
+		}
+		scribble(c.Metadata)
+		after, err := p.MarshalCanonical()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(before, after) {
+			return errors.New("mutating the clone changed the original")
+		}
+		return nil
+	})
+}
+
+// Overwrites every value in place, recursing into nested maps and slices
+func scribble(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if v == nil {
+			return
+		}
+		for k, val := range v {
+			scribble(val)
+			if _, nested := val.(map[string]interface{}); !nested {
+				v[k] = "scribbled"
+			}
+		}
+		v["scribbled"] = true
+	case []interface{}:
+		for i, val := range v {
+			scribble(val)
+			v[i] = "scribbled"
+		}
+	}
+}
+
+// Canonical bytes must not depend on object key order in the input or on
+// the time zone the timestamps were recorded in
+func TestPropertyCanonicalJSONDeterminism(t *testing.T) {
+	zones := []*time.Location{time.UTC, time.FixedZone("east", 14*3600), time.FixedZone("west", -12*3600)}
+	checkProperty(t, 200, genPerson, func(p Person) error {
+		want, err := p.MarshalCanonical()
+		if err != nil {
+			return err
+		}
+
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(want, &fields); err != nil {
+			return err
+		}
+		keys := slices.Collect(maps.Keys(fields))
+		rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+		var shuffled bytes.Buffer
+		shuffled.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				shuffled.WriteByte(',')
+			}
+			fmt.Fprintf(&shuffled, "%q:%s", k, fields[k])
+		}
+		shuffled.WriteByte('}')
+
+		var q Person
+		if err := json.Unmarshal(shuffled.Bytes(), &q); err != nil {
+			return err
+		}
+		zone := zones[len(keys)%len(zones)]
+		q.Created = q.Created.In(zone)
+		q.BirthDate = q.BirthDate.In(zone)
+		got, err := q.MarshalCanonical()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, want) {
+			return fmt.Errorf("canonical JSON differs for input %s:\n got %s\nwant %s", shuffled.Bytes(), got, want)
+		}
+		return nil
+	})
+}
+
+func TestMapKeys(t *testing.T) {
+	people := map[UserID]Person{1: {ID: 1, Name: "Ann"}, 2: {ID: 2, Name: "Bob"}}
+
+	byName, err := MapKeys(people, func(id UserID) string { return "user-" + strconv.FormatInt(int64(id), 10) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Person{"user-1": people[1], "user-2": people[2]}
+	if !reflect.DeepEqual(byName, want) {
+		t.Errorf("MapKeys = %v, want %v", byName, want)
+	}
+
+	byParity, err := MapKeys(people, func(id UserID) bool { return id%2 == 0 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byParity) != 2 || byParity[false].Name != "Ann" || byParity[true].Name != "Bob" {
+		t.Errorf("MapKeys by parity = %v", byParity)
+	}
+
+	got, err := MapKeys(people, func(UserID) string { return "same" })
+	if err == nil {
+		t.Fatalf("colliding rekey returned %v, want an error", got)
+	}
+	if got != nil {
+		t.Errorf("colliding rekey returned a partial map %v", got)
+	}
+	if !strings.Contains(err.Error(), "same") {
+		t.Errorf("error %q does not name the colliding key", err)
+	}
+}
+
+func TestRender(t *testing.T) {
+	email := "ann@example.com"
+	tests := []struct {
+		name string
+		p    Person
+		tmpl string
+		want string
+	}{
+		{"fields", Person{Name: "Ann", Age: 30}, "Hi {{.Name}}, age {{.Age}}", "Hi Ann, age 30"},
+		{"upper", Person{Name: "Ann"}, "{{upper .Name}}", "ANN"},
+		{"default for nil email", Person{}, `{{default "n/a" .Email}}`, "n/a"},
+		{"default dereferences email", Person{Email: &email}, `{{default "n/a" .Email}}`, email},
+		{"default for empty name", Person{}, `{{default "friend" .Name}}`, "friend"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.p.Render(tt.tmpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Render(%q) = %q, want %q", tt.tmpl, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := (Person{}).Render("{{.Name"); err == nil || !strings.HasPrefix(err.Error(), "parse template:") {
+		t.Errorf("unclosed action: error %v, want a parse template error", err)
+	}
+	if _, err := (Person{}).Render("{{.Nickname}}"); err == nil || !strings.HasPrefix(err.Error(), "render template:") {
+		t.Errorf("unknown field: error %v, want a render template error", err)
+	}
+}
+
+func TestSyncMapConcurrent(t *testing.T) {
+	var m SyncMap[UserID, Person]
+	const writers, perWriter = 8, 200
+
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				id := UserID(w*perWriter + i)
+				m.Store(id, Person{ID: id})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				id := UserID(w*perWriter + i)
+				if p, ok := m.Load(id); ok && p.ID != id {
+					t.Errorf("Load(%d) returned person %d", id, p.ID)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	n := 0
+	m.Range(func(id UserID, p Person) bool {
+		if p.ID != id {
+			t.Errorf("Range: key %d holds person %d", id, p.ID)
+		}
+		n++
+		return true
+	})
+	if n != writers*perWriter {
+		t.Errorf("Range visited %d entries, want %d", n, writers*perWriter)
+	}
+
+	var stored atomic.Int32
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, loaded := m.LoadOrStore(-1, Person{Name: "first"}); !loaded {
+				stored.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := stored.Load(); got != 1 {
+		t.Errorf("LoadOrStore stored %d times, want exactly 1", got)
+	}
+
+	m.Delete(-1)
+	if _, ok := m.Load(-1); ok {
+		t.Error("Load found a deleted key")
+	}
+	visited := 0
+	m.Range(func(UserID, Person) bool { visited++; return false })
+	if visited != 1 {
+		t.Errorf("Range visited %d entries after fn returned false, want 1", visited)
+	}
+}
+
+func TestMarshalForRole(t *testing.T) {
+	e := xmlFixture()
+	for _, tt := range []struct {
+		role       string
+		wantSalary bool
+	}{
+		{"employee", false},
+		{"", false},
+		{"HR", false},
+		{"hr", true},
+		{"manager", true},
+	} {
+		t.Run(tt.role, func(t *testing.T) {
+			data, err := e.MarshalFor(tt.role)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(data, &fields); err != nil {
+				t.Fatal(err)
+			}
+			salary, ok := fields["salary"]
+			if ok != tt.wantSalary {
+				t.Fatalf("salary present = %v, want %v in %s", ok, tt.wantSalary, data)
+			}
+			if ok && string(salary) != "85000.5" {
+				t.Errorf("salary = %s, want 85000.5", salary)
+			}
+			if string(fields["department"]) != `"Engineering"` || string(fields["id"]) != "1" {
+				t.Errorf("department or embedded person fields missing: %s", data)
+			}
+		})
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	ageGroup := func(p Person) string {
+		switch {
+		case p.Age < 18:
+			return "minor"
+		case p.Age < 40:
+			return "18-39"
+		case p.Age < 65:
+			return "40-64"
+		default:
+			return "65+"
+		}
+	}
+	var people []Person
+	for _, age := range []int{5, 17, 18, 39, 40, 41, 64, 65, 90, 30} {
+		people = append(people, Person{Age: age})
+	}
+	got := Histogram(people, ageGroup)
+	want := Table[string, int]{"minor": 2, "18-39": 3, "40-64": 3, "65+": 2}
+	if !maps.Equal(got, want) {
+		t.Errorf("Histogram by age group = %v, want %v", got, want)
+	}
+
+	bySalaryBand := Histogram([]Employee{{Salary: 40000}, {Salary: 85000.5}, {Salary: 99999}}, func(e Employee) int {
+		return int(e.Salary) / 50000
+	})
+	if !maps.Equal(bySalaryBand, Table[int, int]{0: 1, 1: 2}) {
+		t.Errorf("Histogram by salary band = %v", bySalaryBand)
+	}
+	if h := Histogram(nil, ageGroup); h == nil || len(h) != 0 {
+		t.Errorf("Histogram(nil) = %#v, want an empty non-nil map", h)
+	}
+}
+
+// Clock whose Sleep blocks until release is closed, so only the context
+// can end a fetch
+type blockingClock struct {
+	realClock
+	release chan struct{}
+}
+
+func (c blockingClock) Sleep(time.Duration) { <-c.release }
+
+func TestDefaultTimeout(t *testing.T) {
+	t.Cleanup(func() { SetEnforceDefaultTimeout(true) })
+	clock := blockingClock{release: make(chan struct{})}
+	t.Cleanup(func() { close(clock.release) })
+
+	SetEnforceDefaultTimeout(true)
+	before := time.Now()
+	ctx, cancel := withDefaultTimeout(context.Background())
+	deadline, ok := ctx.Deadline()
+	cancel()
+	if !ok {
+		t.Fatal("background context got no deadline with enforcement on")
+	}
+	if d := deadline.Sub(before); d < DefaultTimeout || d > DefaultTimeout+time.Second {
+		t.Errorf("deadline %v after the call, want about DefaultTimeout (%v)", d, DefaultTimeout)
+	}
+	if !errors.Is(ctx.Err(), context.Canceled) {
+		t.Errorf("cancel did not release the derived context: %v", ctx.Err())
+	}
+
+	// A caller's own deadline wins, even one shorter than the default
+	short, cancelShort := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelShort()
+	if _, err := fetchUserData(short, clock, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("fetch with a short deadline: error %v, want DeadlineExceeded", err)
+	}
+	want, _ := short.Deadline()
+	ctx, cancel = withDefaultTimeout(short)
+	got, _ := ctx.Deadline()
+	cancel()
+	if !got.Equal(want) {
+		t.Errorf("caller deadline replaced: got %v, want %v", got, want)
+	}
+
+	SetEnforceDefaultTimeout(false)
+	ctx, cancel = withDefaultTimeout(context.Background())
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("deadline applied with enforcement off")
+	}
+}
+
+func TestValidatePeopleJSON(t *testing.T) {
+	payloads := [][]byte{
+		[]byte(validPersonJSON),
+		[]byte(`{"id": 7, "name": "Bob", "age": 41, "status": "pending"}`),
+		[]byte(`{"id": 8, "name": "", "age": 20, "status": "active"}`),
+	}
+	errs := ValidatePeopleJSON(payloads)
+	if len(errs) != len(payloads) {
+		t.Fatalf("got %d results for %d payloads", len(errs), len(payloads))
+	}
+	if errs[0] != nil || errs[1] != nil {
+		t.Errorf("valid payloads rejected: %v, %v", errs[0], errs[1])
+	}
+	var fe *FieldError
+	if errs[2] == nil || !errors.As(errs[2], &fe) || fe.Field != "name" {
+		t.Fatalf("payload 2: error %v, want a name field error", errs[2])
+	}
+	if !strings.HasPrefix(errs[2].Error(), "payload 2:") {
+		t.Errorf("error %q does not carry the payload index", errs[2])
+	}
+	if errs := ValidatePeopleJSON(nil); len(errs) != 0 {
+		t.Errorf("ValidatePeopleJSON(nil) = %v", errs)
+	}
+}
+
+func TestSplitWhen(t *testing.T) {
+	descending := func(prev, cur int) bool { return cur < prev }
+	tests := []struct {
+		in   []int
+		want [][]int
+	}{
+		{nil, nil},
+		{[]int{4}, [][]int{{4}}},
+		{[]int{1, 2, 3}, [][]int{{1, 2, 3}}},
+		{[]int{1, 3, 5, 2, 4, 0, 9, 9}, [][]int{{1, 3, 5}, {2, 4}, {0, 9, 9}}},
+		{[]int{3, 2, 1}, [][]int{{3}, {2}, {1}}},
+	}
+	for _, tt := range tests {
+		got := SplitWhen(tt.in, descending)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitWhen(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+
+	// Groups share the input's backing array but must not grow into the
+	// next group
+	in := []int{1, 2, 0, 5}
+	groups := SplitWhen(in, descending)
+	_ = append(groups[0], 99)
+	if in[2] != 0 {
+		t.Errorf("appending to the first group overwrote the input: %v", in)
+	}
+}
+
+func TestChecksumDetectsEveryField(t *testing.T) {
+	base := xmlFixture().Person
+	sum := base.Checksum()
+	if len(sum) != 64 || !VerifyPerson(base, sum) || !VerifyPerson(base, strings.ToUpper(sum)) {
+		t.Fatalf("checksum %q does not verify its own person", sum)
+	}
+
+	mutations := map[string]func(*Person){
+		"id":          func(p *Person) { p.ID++ },
+		"name":        func(p *Person) { p.Name += "." },
+		"age":         func(p *Person) { p.Age++ },
+		"birth_date":  func(p *Person) { p.BirthDate = p.BirthDate.AddDate(0, 0, 1) },
+		"email":       func(p *Person) { e := "bob@example.com"; p.Email = &e },
+		"email nil":   func(p *Person) { p.Email = nil },
+		"status":      func(p *Person) { p.Status = StatusPending },
+		"created":     func(p *Person) { p.Created = p.Created.Add(time.Nanosecond) },
+		"tags":        func(p *Person) { p.Tags = append(p.Tags, "rust") },
+		"tag order":   func(p *Person) { slices.Reverse(p.Tags) },
+		"metadata":    func(p *Person) { p.Metadata["level"] = "junior" },
+		"permissions": func(p *Person) { p.Permissions |= PermAdmin },
+	}
+	// Fields added to Person later must get a mutation here too
+	if n := reflect.TypeFor[Person]().NumField(); n != 10 {
+		t.Errorf("Person has %d fields; update the mutation list", n)
+	}
+	for name, mutate := range mutations {
+		t.Run(name, func(t *testing.T) {
+			p := base.CopyWith(mutate)
+			if p.Checksum() == sum {
+				t.Errorf("checksum unchanged after mutating %s", name)
+			}
+			if VerifyPerson(p, sum) {
+				t.Errorf("VerifyPerson accepted the old checksum after mutating %s", name)
+			}
+		})
+	}
+
+	// Same instant in another zone is the same record
+	moved := base.CopyWith(func(p *Person) { p.Created = p.Created.In(time.FixedZone("CET", 3600)) })
+	if moved.Checksum() != sum {
+		t.Error("checksum depends on the time zone of Created")
+	}
+	if VerifyPerson(base, "") {
+		t.Error("VerifyPerson accepted an empty checksum")
+	}
+}
+
+func TestEnumerate(t *testing.T) {
+	names := []string{"Ann", "Bob", "Cy", "Dee"}
+	pairs := Enumerate(names)
+	if len(pairs) != len(names) {
+		t.Fatalf("Enumerate returned %d pairs for %d items", len(pairs), len(names))
+	}
+	for i, pair := range pairs {
+		if pair.Index != i || pair.Value != names[i] {
+			t.Errorf("pair %d = {%d %q}, want {%d %q}", i, pair.Index, pair.Value, i, names[i])
+		}
+	}
+	if got := Enumerate([]int(nil)); len(got) != 0 {
+		t.Errorf("Enumerate(nil) = %v, want empty", got)
+	}
+}
+
+func TestSimilarTo(t *testing.T) {
+	email := func(s string) *string { return &s }
+	jon := Person{Name: "Jon Smith", Age: 42, Email: email("jsmith@example.com")}
+	john := Person{Name: "John Smith", Age: 42, Email: email(" JSmith@example.com")}
+	unrelated := Person{Name: "Maria Garcia", Age: 27, Email: email("maria@example.org")}
+
+	if s := jon.SimilarTo(john); s < 0.9 {
+		t.Errorf("Jon Smith vs John Smith scored %.3f, want >= 0.9", s)
+	}
+	if s := jon.SimilarTo(unrelated); s > 0.3 {
+		t.Errorf("Jon Smith vs Maria Garcia scored %.3f, want <= 0.3", s)
+	}
+	if s := jon.SimilarTo(jon); s != 1 {
+		t.Errorf("self similarity = %v, want 1", s)
+	}
+	if a, b := jon.SimilarTo(john), john.SimilarTo(jon); a != b {
+		t.Errorf("SimilarTo not symmetric: %v vs %v", a, b)
+	}
+
+	if !LikelyDuplicate(jon, john, 0.85) {
+		t.Error("Jon/John Smith not flagged as a likely duplicate")
+	}
+	if LikelyDuplicate(jon, unrelated, 0.85) {
+		t.Error("unrelated people flagged as likely duplicates")
+	}
+}
+
+func TestRepeat(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := Repeat(ctx, "a", "b")
+	var got []string
+	for range 5 {
+		got = append(got, <-ch)
+	}
+	if want := []string{"a", "b", "a", "b", "a"}; !slices.Equal(got, want) {
+		t.Errorf("first five values = %v, want %v", got, want)
+	}
+
+	cancel()
+	closed := make(chan struct{})
+	go func() {
+		for range ch {
+		}
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("channel not closed after cancel")
+	}
+
+	if _, ok := <-Repeat[int](context.Background()); ok {
+		t.Error("Repeat with no values emitted a value")
+	}
+}
+
+func TestStatusObservers(t *testing.T) {
+	a := NewAuditedPerson(Person{ID: 7, Status: StatusPending}, nil)
+
+	type transition struct {
+		id       UserID
+		from, to Status
+	}
+	var seen []transition
+	var order []string
+	a.OnStatusChange(func(id UserID, from, to Status) {
+		seen = append(seen, transition{id, from, to})
+		order = append(order, "first")
+	})
+	a.OnStatusChange(func(UserID, Status, Status) { panic("observer bug") })
+	a.OnStatusChange(func(UserID, Status, Status) { order = append(order, "third") })
+
+	if err := a.TransitionTo(StatusActive); err != nil {
+		t.Fatal(err)
+	}
+	if want := []transition{{7, StatusPending, StatusActive}}; !slices.Equal(seen, want) {
+		t.Errorf("observed %v, want %v", seen, want)
+	}
+	if !slices.Equal(order, []string{"first", "third"}) {
+		t.Errorf("observers ran as %v; a panicking observer must not stop later ones", order)
+	}
+	if got := a.Person().Status; got != StatusActive {
+		t.Errorf("status = %q after a panicking observer, want active", got)
+	}
+
+	// No-op and rejected transitions notify nobody
+	if err := a.TransitionTo(StatusActive); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.TransitionTo("retired"); err == nil {
+		t.Error("invalid status accepted")
+	}
+	if len(seen) != 1 {
+		t.Errorf("observers fired %d times, want 1", len(seen))
+	}
+}
+
+func TestShuffleSameSeedSamePermutation(t *testing.T) {
+	base := make([]int, 50)
+	for i := range base {
+		base[i] = i
+	}
+	a := ShuffledCopy(base, mathrand.New(mathrand.NewSource(42)))
+	b := ShuffledCopy(base, mathrand.New(mathrand.NewSource(42)))
+	if !slices.Equal(a, b) {
+		t.Fatalf("same seed gave different permutations:\n%v\n%v", a, b)
+	}
+	if slices.Equal(a, base) {
+		t.Error("shuffle left 50 items in their original order")
+	}
+	if c := ShuffledCopy(base, mathrand.New(mathrand.NewSource(43))); slices.Equal(a, c) {
+		t.Error("different seeds gave the same permutation")
+	}
+	if !slices.Equal(slices.Sorted(slices.Values(a)), base) {
+		t.Errorf("shuffle is not a permutation: %v", a)
+	}
+	for i, v := range base {
+		if v != i {
+			t.Fatal("ShuffledCopy modified its input")
+		}
+	}
+
+	inPlace := slices.Clone(base)
+	Shuffle(inPlace, mathrand.New(mathrand.NewSource(42)))
+	if !slices.Equal(inPlace, a) {
+		t.Error("Shuffle and ShuffledCopy disagree for the same seed")
+	}
+	Shuffle(inPlace, nil) // package default source
+	Shuffle([]int(nil), nil)
+}
+
+func TestColumnSpecs(t *testing.T) {
+	specs, err := ColumnSpecs(&ConfigRecord{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ColumnSpec{
+		{Field: "Name", Column: "name", PrimaryKey: true, Required: true},
+		{Field: "Region", Column: "region", Doc: `data center, e.g. "eu-west"`},
+		{Field: "Replicas", Column: "replicas"},
+		{Field: "Owner", Column: "owner"},
+		{Field: "Token", Column: "token", Redacted: true},
+	}
+	if !slices.Equal(specs, want) {
+		t.Errorf("ColumnSpecs =\n%+v\nwant\n%+v", specs, want)
+	}
+
+	// The tag that looks malformed still follows encoding/json's rules
+	data, err := json.Marshal(ConfigRecord{Owner: "ops", Token: "secret", Replicas: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"region":"","replicas":"3","-":"ops","Scratch":""}`; string(data) != want {
+		t.Errorf("json = %s, want %s", data, want)
+	}
+
+	if _, err := ColumnSpecs(42); err == nil {
+		t.Error("ColumnSpecs accepted a non-struct")
+	}
+	if _, err := ColumnSpecs(nil); err == nil {
+		t.Error("ColumnSpecs accepted nil")
+	}
+}
+
+// Clock handing out preset times in order, to record entries out of
+// chronological order
+type sequenceClock struct {
+	realClock
+	times []time.Time
+}
+
+func (c *sequenceClock) Now() time.Time {
+	t := c.times[0]
+	c.times = c.times[1:]
+	return t
+}
+
+func TestAuditTrailChronological(t *testing.T) {
+	base := time.Date(2024, time.March, 1, 9, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(base)
+	trail := &AuditTrail{Clock: clock}
+	release := make(chan struct{})
+	sink := trail.Sink()
+	a := NewAuditedPersonWithOptions(Person{ID: 1, Name: "Ann", Status: StatusPending}, func(id UserID, at time.Time, field string, old, new interface{}) {
+		<-release
+		sink(id, at, field, old, new)
+	}, AuditOptions{Clock: clock})
+	if err := a.SetEmail("ann@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+	if err := a.TransitionTo(StatusActive); err != nil {
+		t.Fatal(err)
+	}
+	// The sink only catches up an hour later; entries keep their mutation times
+	clock.Advance(time.Hour)
+	close(release)
+	a.Close()
+
+	var got []Change
+	data, err := json.Marshal(trail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Field != "email" || got[1].Field != "status" ||
+		!got[0].At.Equal(base) || !got[1].At.Equal(base.Add(time.Minute)) {
+		t.Fatalf("trail = %s, want email at 09:00 then status at 09:01", data)
+	}
+
+	// Entries recorded out of order are exported oldest first
+	seq := &AuditTrail{Clock: &sequenceClock{times: []time.Time{base.Add(time.Hour), base, base.Add(time.Hour)}}}
+	seq.Record("late", nil, 1)
+	seq.Record("early", nil, 2)
+	seq.Record("late again", nil, 3)
+	var fields []string
+	for _, c := range seq.Changes() {
+		fields = append(fields, c.Field)
+	}
+	if want := []string{"early", "late", "late again"}; !slices.Equal(fields, want) {
+		t.Errorf("changes ordered %v, want %v", fields, want)
+	}
+
+	if data, err := json.Marshal(&AuditTrail{}); err != nil || string(data) != "[]" {
+		t.Errorf("empty trail marshals to %s, %v; want []", data, err)
+	}
+}
+
+func TestMinMax(t *testing.T) {
+	values := make([]int, 100)
+	for i := range values {
+		values[i] = i - 30
+	}
+	Shuffle(values, mathrand.New(mathrand.NewSource(7)))
+	if lo, hi, ok := MinMax(values); !ok || lo != -30 || hi != 69 {
+		t.Errorf("MinMax(shuffled) = %d, %d, %v; want -30, 69, true", lo, hi, ok)
+	}
+
+	if lo, hi, ok := MinMax([]string{"pear", "apple", "zucchini", "fig"}); !ok || lo != "apple" || hi != "zucchini" {
+		t.Errorf("MinMax(strings) = %q, %q, %v", lo, hi, ok)
+	}
+	if lo, hi, ok := MinMax([]float64{math.NaN(), 2, math.NaN(), -1}); !ok || lo != -1 || hi != 2 {
+		t.Errorf("MinMax with NaNs = %v, %v, %v; want -1, 2, true", lo, hi, ok)
+	}
+	if lo, hi, ok := MinMax([]float64{math.NaN()}); ok || lo != 0 || hi != 0 {
+		t.Errorf("MinMax(all NaN) = %v, %v, %v; want zero values and false", lo, hi, ok)
+	}
+	if lo, hi, ok := MinMax([]int{}); ok || lo != 0 || hi != 0 {
+		t.Errorf("MinMax(empty) = %v, %v, %v; want 0, 0, false", lo, hi, ok)
+	}
+}
+
+func TestFormatInfoLocales(t *testing.T) {
+	tests := []struct {
+		salary     float64
+		enUS, deDE string
+	}{
+		{1234567.891, "$1,234,567.89", "1.234.567,89 €"},
+		{85000.5, "$85,000.50", "85.000,50 €"},
+		{999, "$999.00", "999,00 €"},
+		{0, "$0.00", "0,00 €"},
+		{-1500, "-$1,500.00", "-1.500,00 €"},
+		{-0.001, "$0.00", "0,00 €"},
+	}
+	for _, tt := range tests {
+		if got := localeFormats["en-US"].money(tt.salary); got != tt.enUS {
+			t.Errorf("en-US money(%v) = %q, want %q", tt.salary, got, tt.enUS)
+		}
+		if got := localeFormats["de-DE"].money(tt.salary); got != tt.deDE {
+			t.Errorf("de-DE money(%v) = %q, want %q", tt.salary, got, tt.deDE)
+		}
+	}
+
+	e := xmlFixture()
+	if got, want := e.FormatInfo("en-US"), "Alice & Co <HQ> works in Engineering with salary $85,000.50 (since 01/01/2024)"; got != want {
+		t.Errorf("FormatInfo(en-US) = %q, want %q", got, want)
+	}
+	if got, want := e.FormatInfo("de-DE"), "Alice & Co <HQ> works in Engineering with salary 85.000,50 € (since 01.01.2024)"; got != want {
+		t.Errorf("FormatInfo(de-DE) = %q, want %q", got, want)
+	}
+	if e.FormatInfo("xx-XX") != e.GetFullInfo() || e.GetFullInfo() != e.FormatInfo("en-US") {
+		t.Error("unknown locales and GetFullInfo must use en-US")
+	}
+}
+
+func TestWeekdayString(t *testing.T) {
+	names := []string{"Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday", "Sunday"}
+	for i, want := range names {
+		if got := Weekday(i + 1).String(); got != want {
+			t.Errorf("Weekday(%d) = %q, want %q", i+1, got, want)
+		}
+	}
+	if got := Weekday(0).String(); got != "Weekday(0)" {
+		t.Errorf("unset Weekday = %q, want Weekday(0)", got)
+	}
+	if got := fmt.Sprint(Weekday(8)); got != "Weekday(8)" {
+		t.Errorf("out of range Weekday = %q, want Weekday(8)", got)
+	}
+
+	// 2024-03-04 was a Monday; Sunday maps to 7, not time.Sunday's 0
+	start := time.Date(2024, time.March, 4, 12, 0, 0, 0, time.UTC)
+	for i, want := range names {
+		if got := weekdayOf(start.AddDate(0, 0, i)).String(); got != want {
+			t.Errorf("weekdayOf(%s) = %s, want %s", start.AddDate(0, 0, i).Format(time.DateOnly), got, want)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	if got := Compact([]string{"", "a", "", "b", "c", ""}); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("Compact(strings) = %q", got)
+	}
+	if got := Compact([]int{0, 3, 0, 0, 1, 2, 0}); !slices.Equal(got, []int{3, 1, 2}) {
+		t.Errorf("Compact(ints) = %v", got)
+	}
+	if got := Compact([]int{0, 0}); got == nil || len(got) != 0 {
+		t.Errorf("Compact(all zero) = %#v, want an empty non-nil slice", got)
+	}
+
+	in := []int{1, 0, 2}
+	out := Compact(in)
+	out[0] = 99
+	if in[0] != 1 {
+		t.Error("Compact result aliases its input")
+	}
+
+	// Person holds slices and maps, so it needs the predicate form
+	people := []Person{{Name: "Ann"}, {}, {Name: "Bob", Tags: []string{}}}
+	kept := CompactFunc(people, func(p Person) bool { return p.Name == "" })
+	if len(kept) != 2 || kept[0].Name != "Ann" || kept[1].Name != "Bob" {
+		t.Errorf("CompactFunc(people) = %+v", kept)
+	}
+}
+
+func TestEmbeddedSeed(t *testing.T) {
+	// Editing testdata/seed.json must be deliberate: update this digest too
+	const seedSHA256 = "0fa39e4a80592a3b2f431b804e0fd6c1849632a713bf98bb26d5f0e14518ca0f"
+	raw, err := embeddedAssets.ReadFile("testdata/seed.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256(raw); hex.EncodeToString(sum[:]) != seedSHA256 {
+		t.Errorf("embedded seed digest %x, want %s", sum, seedSHA256)
+	}
+
+	people, err := LoadEmbeddedSeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(people) == 0 {
+		t.Fatal("embedded seed is empty")
+	}
+	seen := make(map[UserID]bool)
+	for _, p := range people {
+		if err := p.Validate(); err != nil {
+			t.Errorf("seed person %d: %v", p.ID, err)
+		}
+		if seen[p.ID] {
+			t.Errorf("seed id %d appears twice", p.ID)
+		}
+		seen[p.ID] = true
+	}
+
+	greeting, err := people[0].Render(greetingTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Hello, ALICE <alice@example.com> [active]"; strings.TrimSpace(greeting) != want {
+		t.Errorf("greeting = %q, want %q", greeting, want)
+	}
+}
+
+func TestMasked(t *testing.T) {
+	p := xmlFixture().Person
+	p.Metadata["ip_address"] = "192.168.1.1"
+	m := p.Masked()
+
+	if m.Email == nil || *m.Email != "a***@example.com" {
+		t.Fatalf("masked email = %v, want a***@example.com", m.Email)
+	}
+	if _, ok := m.Metadata["ip_address"]; ok {
+		t.Error("masked copy still has ip_address")
+	}
+	if m.Metadata["level"] != "senior" || m.Name != p.Name {
+		t.Error("masking dropped fields it should keep")
+	}
+	if *p.Email != "alice@example.com" || p.Metadata["ip_address"] != "192.168.1.1" {
+		t.Error("Masked modified the original person")
+	}
+
+	for email, want := range map[string]string{
+		"bob.smith@mail.example.org": "b***@mail.example.org",
+		"émile@example.fr":           "é***@example.fr",
+		"x@y.z":                      "x***@y.z",
+		"@example.com":               "***",
+		"no-at-sign":                 "***",
+	} {
+		if got := maskEmail(email); got != want {
+			t.Errorf("maskEmail(%q) = %q, want %q", email, got, want)
+		}
+	}
+	if (Person{}).Masked().Email != nil {
+		t.Error("masking invented an email")
+	}
+}
+
+func TestDuplicateGroups(t *testing.T) {
+	people := []Person{
+		{ID: 1, Name: "Ann"},
+		{ID: 2, Name: "Bob"},
+		{ID: 3, Name: "Ann"},
+		{ID: 4, Name: "Cy"},
+		{ID: 5, Name: "Bob"},
+		{ID: 6, Name: "Ann"},
+	}
+	groups := DuplicateGroups(people, func(p Person) string { return p.Name })
+
+	ids := func(group []Person) []UserID {
+		var out []UserID
+		for _, p := range group {
+			out = append(out, p.ID)
+		}
+		return out
+	}
+	if len(groups) != 2 {
+		t.Fatalf("got %d groups, want Ann and Bob only: %v", len(groups), groups)
+	}
+	if got := ids(groups["Ann"]); !slices.Equal(got, []UserID{1, 3, 6}) {
+		t.Errorf("Ann group = %v, want [1 3 6] in input order", got)
+	}
+	if got := ids(groups["Bob"]); !slices.Equal(got, []UserID{2, 5}) {
+		t.Errorf("Bob group = %v, want [2 5]", got)
+	}
+	if _, ok := groups["Cy"]; ok {
+		t.Error("singleton Cy reported as a duplicate")
+	}
+	if g := DuplicateGroups([]Person(nil), func(p Person) string { return p.Name }); len(g) != 0 {
+		t.Errorf("DuplicateGroups(nil) = %v", g)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	source := func(values ...int) <-chan int {
+		ch := make(chan int)
+		go func() {
+			defer close(ch)
+			for _, v := range values {
+				ch <- v
+			}
+		}()
+		return ch
+	}
+
+	var got []int
+	for v := range Merge(context.Background(), source(1, 3, 5), source(2, 4)) {
+		got = append(got, v)
+	}
+	slices.Sort(got)
+	if !slices.Equal(got, []int{1, 2, 3, 4, 5}) {
+		t.Errorf("Merge = %v, want all five values", got)
+	}
+
+	// One source finishing early must not stall the other
+	empty := make(chan int)
+	close(empty)
+	got = nil
+	for v := range Merge(context.Background(), empty, source(7, 8)) {
+		got = append(got, v)
+	}
+	if !slices.Equal(got, []int{7, 8}) {
+		t.Errorf("Merge with a closed source = %v, want [7 8]", got)
+	}
+
+	// Cancelling closes the output even while sources stay open
+	ctx, cancel := context.WithCancel(context.Background())
+	never := make(chan int)
+	out := Merge(ctx, never, never)
+	cancel()
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Error("cancelled merge produced a value")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancelled merge did not close its output")
+	}
+}
+
+func TestTrySendReceive(t *testing.T) {
+	mailbox := make(chan string, 1)
+	if !TrySend(mailbox, "hello") {
+		t.Fatal("send to an empty buffer failed")
+	}
+	if TrySend(mailbox, "again") {
+		t.Error("send to a full buffer succeeded")
+	}
+	if msg, ok := TryReceive(mailbox); !ok || msg != "hello" {
+		t.Errorf("TryReceive = %q, %v; want hello, true", msg, ok)
+	}
+	if _, ok := TryReceive(mailbox); ok {
+		t.Error("receive from an empty buffer succeeded")
+	}
+
+	var nilChan chan int
+	if TrySend(nilChan, 1) {
+		t.Error("send on a nil channel succeeded")
+	}
+	if _, ok := TryReceive(nilChan); ok {
+		t.Error("receive on a nil channel succeeded")
+	}
+}
+
+// Context that cancels itself once Done has been consulted n times,
+// stopping a pipeline partway through without timing assumptions
+type cancelAfterCtx struct {
+	context.Context
+	cancel context.CancelFunc
+	calls  atomic.Int64
+	n      int64
+}
+
+func (c *cancelAfterCtx) Done() <-chan struct{} {
+	if c.calls.Add(1) == c.n {
+		c.cancel()
+	}
+	return c.Context.Done()
+}
+
+func TestProcessJobsCtxCancelledMidRun(t *testing.T) {
+	jobs := make([]int, 10000)
+	for i := range jobs {
+		jobs[i] = i
+	}
+
+	if out, err := ProcessJobsCtx(context.Background(), jobs[:100], 4); err != nil || len(out) != 100 || out[99] != 198 {
+		t.Fatalf("uncancelled run: %d results, %v", len(out), err)
+	}
+
+	baseline := runtime.NumGoroutine()
+	parent, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx := &cancelAfterCtx{Context: parent, cancel: cancel, n: 500}
+	out, err := ProcessJobsCtx(ctx, jobs, 4)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("error = %v, want context.Canceled", err)
+	}
+	if len(out) == 0 || len(out) >= len(jobs) {
+		t.Fatalf("got %d results, want a partial set", len(out))
+	}
+	for i := 1; i < len(out); i++ {
+		if out[i]%2 != 0 || out[i] <= out[i-1] {
+			t.Fatalf("partial results not doubled jobs in input order: ...%d, %d", out[i-1], out[i])
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines still running, baseline %d", runtime.NumGoroutine(), baseline)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAliasesAreIdentical(t *testing.T) {
+	// Aliases are the same type as their targets, so values cross freely
+	var list PersonList = []Person{{Name: "Ann"}}
+	var plain []Person = list
+	if reflect.TypeFor[PersonList]() != reflect.TypeFor[[]Person]() || len(plain) != 1 {
+		t.Error("PersonList is not identical to []Person")
+	}
+
+	var byName Table[string, int] = map[string]int{"Ann": 1}
+	var m map[string]int = byName
+	if reflect.TypeFor[Table[string, int]]() != reflect.TypeFor[map[string]int]() || m["Ann"] != 1 {
+		t.Error("Table[string, int] is not identical to map[string]int")
+	}
+	var counts map[Status]int = Histogram(list, func(p Person) Status { return p.Status })
+	if counts[""] != 1 {
+		t.Errorf("Histogram through the alias = %v", counts)
+	}
+
+	var grace Duration = 1500 * time.Millisecond
+	var wait time.Duration = grace
+	if reflect.TypeFor[Duration]() != reflect.TypeFor[time.Duration]() || wait.String() != "1.5s" {
+		t.Error("Duration alias lost time.Duration's identity or methods")
+	}
+
+	// A definition is a distinct type with its own method set
+	if reflect.TypeFor[Timeout]() == reflect.TypeFor[time.Duration]() {
+		t.Error("Timeout should be a defined type, not an alias")
+	}
+	if got := Timeout(grace).String(); got != "timeout after 1.5s" {
+		t.Errorf("Timeout.String() = %q", got)
+	}
+}
+
+func TestIndexLastWinsFirstWins(t *testing.T) {
+	people := []Person{
+		{ID: 1, Name: "Ann"},
+		{ID: 2, Name: "Bob"},
+		{ID: 1, Name: "Ann (renamed)"},
+		{ID: 3, Name: "Cy"},
+		{ID: 1, Name: "Ann (again)"},
+	}
+	byID := func(p Person) UserID { return p.ID }
+
+	var last map[UserID]Person = Index(people, byID)
+	var first map[UserID]Person = IndexFirst(people, byID)
+	if len(last) != 3 || len(first) != 3 {
+		t.Fatalf("index sizes %d and %d, want 3 distinct ids", len(last), len(first))
+	}
+	if got := last[1].Name; got != "Ann (again)" {
+		t.Errorf("Index kept %q for id 1, want the last occurrence", got)
+	}
+	if got := first[1].Name; got != "Ann" {
+		t.Errorf("IndexFirst kept %q for id 1, want the first occurrence", got)
+	}
+	for _, id := range []UserID{2, 3} {
+		if last[id].Name != first[id].Name {
+			t.Errorf("unique id %d differs: %q vs %q", id, last[id].Name, first[id].Name)
+		}
+	}
+	if m := Index([]Person(nil), byID); m == nil || len(m) != 0 {
+		t.Errorf("Index(nil) = %#v, want an empty map", m)
+	}
+}
+
+// Pins each behaviour errorsExample prints, on the same tree
+func TestErrorTree(t *testing.T) {
+	err := sampleErrorTree()
+
+	if !errors.Is(err, ErrDivisionByZero) || !errors.Is(err, ErrNotFound) {
+		t.Error("errors.Is misses a sentinel below errors.Join or the second %w")
+	}
+	if errors.Is(err, ErrIndeterminate) {
+		t.Error("errors.Is matched a sentinel that is not in the tree")
+	}
+
+	// As stops at the first match in pre-order: the batch comes before
+	// the division error, and payload 1 before payload 2
+	var coded *CodedError
+	if !errors.As(err, &coded) || coded.Code != CodeInvalid || coded.Message != "invalid person" {
+		t.Errorf("first *CodedError = %+v, want the invalid person error", coded)
+	}
+	var field *FieldError
+	if !errors.As(err, &field) || field.Field != "name" {
+		t.Errorf("first *FieldError = %+v, want field name", field)
+	}
+	var multi interface{ Unwrap() []error }
+	if !errors.As(err, &multi) || multi.(error) != err || len(multi.Unwrap()) != 2 {
+		t.Errorf("interface target matched %T, want the outer two-%%w error itself", multi)
+	}
+	var batch *BatchError
+	if !errors.As(err, &batch) || batch.Total != 3 || len(batch.Errors) != 2 {
+		t.Fatalf("batch = %+v, want 2 of 3 failed", batch)
+	}
+	if !strings.HasPrefix(batch.Errors[0].Error(), "payload 1:") || !strings.HasPrefix(batch.Errors[1].Error(), "payload 2:") {
+		t.Errorf("batch errors lost their payload index: %v", batch.Errors)
+	}
+
+	nodes := errorNodes(err)
+	if nodes[0] != err {
+		t.Error("errorNodes does not start at the root")
+	}
+	var fields []string
+	var kinds []string
+	for _, node := range nodes {
+		switch e := node.(type) {
+		case *BatchError:
+			kinds = append(kinds, "batch")
+		case *FieldError:
+			fields = append(fields, e.Field)
+		case *CodedError:
+			kinds = append(kinds, string(e.Code))
+		}
+	}
+	if !slices.Equal(fields, []string{"name", "extra"}) {
+		t.Errorf("field errors in tree order = %v, want [name extra]", fields)
+	}
+	if want := []string{"batch", "invalid", "invalid", "not_found"}; !slices.Equal(kinds, want) {
+		t.Errorf("typed nodes in pre-order = %v, want %v", kinds, want)
+	}
+	if !errors.Is(nodes[len(nodes)-1], ErrNotFound) {
+		t.Errorf("last node = %v, want the not-found sentinel from the second %%w", nodes[len(nodes)-1])
+	}
+	if errorNodes(nil) != nil {
+		t.Error("errorNodes(nil) is not empty")
+	}
+}
@@ -0,0 +1,8 @@
+//go:build windows
+
+package main
+
+// Command prefix for running a shell snippet on Windows
+func shellCommand(script string) []string {
+	return []string{"cmd.exe", "/C", script}
+}